@@ -0,0 +1,128 @@
+package mill
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/futurehomeno/fimpgo/utils"
+)
+
+const (
+	partnerAuthCodeURL     = "https://partners.futurehome.io/api/control/edge/proxy/custom/auth-code"
+	partnerBetaAuthCodeURL = "https://partners-beta.futurehome.io/api/control/edge/proxy/custom/auth-code"
+)
+
+// AuthCodeProvider gets the authorization code which NewClient exchanges for tokens.
+type AuthCodeProvider interface {
+	// NeedsHubToken is true if AuthCode must be called with a hub token from auth-api.
+	NeedsHubToken() bool
+	AuthCode(hubToken string) (string, error)
+}
+
+// PartnerAuthCodeProvider gets the authorization code through the Futurehome partner API.
+// URL is selected from the hub environment if empty.
+type PartnerAuthCodeProvider struct {
+	URL string
+}
+
+func (p *PartnerAuthCodeProvider) NeedsHubToken() bool {
+	return true
+}
+
+func (p *PartnerAuthCodeProvider) AuthCode(hubToken string) (string, error) {
+	if hubToken == "" {
+		return "", fmt.Errorf("%w: hub token is missing", ErrPartnerAPI)
+	}
+	payloadBytes, err := json.Marshal(map[string]string{"partnerCode": "mill"})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", p.url(), bytes.NewReader(payloadBytes))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+hubToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cache-Control", "no-cache")
+
+	config := Config{}
+	resp, err := http.DefaultClient.Do(req)
+	if err = processHTTPResponse(resp, err, &config); err != nil {
+		if errors.Is(err, ErrUnreachable) {
+			return "", err
+		}
+		return "", fmt.Errorf("%w: %v", ErrPartnerAPI, err)
+	}
+	if config.Data.AuthorizationCode == "" {
+		return "", fmt.Errorf("%w: partner api didn't return an authorization code", ErrAuthCodeMissing)
+	}
+	return config.Data.AuthorizationCode, nil
+}
+
+func (p *PartnerAuthCodeProvider) url() string {
+	if p.URL != "" {
+		return p.URL
+	}
+	hubInfo, err := utils.NewHubUtils().GetHubInfo()
+	if err == nil && hubInfo != nil && hubInfo.Environment != utils.EnvBeta {
+		return partnerAuthCodeURL
+	}
+	// TODO: switch to prod
+	return partnerBetaAuthCodeURL
+}
+
+// MillKeyAuthCodeProvider gets the authorization code directly from Mill using developer credentials from
+// api.millheat.com.
+type MillKeyAuthCodeProvider struct {
+	AccessKey   string
+	SecretToken string
+}
+
+func (p *MillKeyAuthCodeProvider) NeedsHubToken() bool {
+	return false
+}
+
+func (p *MillKeyAuthCodeProvider) AuthCode(hubToken string) (string, error) {
+	if p.AccessKey == "" || p.SecretToken == "" {
+		return "", fmt.Errorf("%w: mill access key and secret token are not set", ErrInvalidCredentials)
+	}
+	req, err := http.NewRequest("POST", apiURL(authPath), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("access_key", p.AccessKey)
+	req.Header.Set("secret_token", p.SecretToken)
+
+	config := Config{}
+	resp, err := http.DefaultClient.Do(req)
+	if err = processHTTPResponse(resp, err, &config); err != nil {
+		return "", err
+	}
+	if err = config.responseError(); err != nil {
+		return "", err
+	}
+	if config.Data.AuthorizationCode == "" {
+		return "", fmt.Errorf("%w: mill didn't return an authorization code", ErrAuthCodeMissing)
+	}
+	return config.Data.AuthorizationCode, nil
+}
+
+// StaticAuthCodeProvider returns a fixed authorization code. It is meant for tests against a local server.
+type StaticAuthCodeProvider struct {
+	Code string
+}
+
+func (p *StaticAuthCodeProvider) NeedsHubToken() bool {
+	return false
+}
+
+func (p *StaticAuthCodeProvider) AuthCode(hubToken string) (string, error) {
+	if p.Code == "" {
+		return "", fmt.Errorf("%w: static authorization code is not set", ErrAuthCodeMissing)
+	}
+	return p.Code, nil
+}
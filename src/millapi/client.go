@@ -1,42 +1,56 @@
 package mill
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
+	"strings"
 
-	"github.com/futurehomeno/edge-mill-adapter/model"
-
-	"github.com/futurehomeno/fimpgo"
-	"github.com/futurehomeno/fimpgo/utils"
 	log "github.com/sirupsen/logrus"
 )
 
+// DefaultBaseURL is mill api url
+const DefaultBaseURL = "https://api.millheat.com/"
+
+// baseURL is DefaultBaseURL unless changed with SetBaseURL, for instance to run against a local server.
+var baseURL = DefaultBaseURL
+
 const (
-	// DefaultBaseURL is mill api url
-	baseURL = "https://api.millheat.com/"
-	// applyAccessTokenURL is mill api to get access_token and refresh_token
-	applyAccessTokenURL = baseURL + "share/applyAccessToken"
-	// authURL is mill api to get authorization_code
-	authURL = baseURL + "share/applyAuthCode"
-	// refreshURL is mill api to update access_token and refresh_token
-	refreshURL = baseURL + "share/refreshtoken?refreshtoken="
-
-	// deviceControlForOpenApiURL is mill api to controll individual devices
-	deviceControlURL = baseURL + "uds/deviceControlForOpenApi"
-	// getIndependentDevicesURL is mill api to get list of devices in unassigned room
-	getIndependentDevicesURL = baseURL + "uds/getIndependentDevices2020"
-	// selectDevicebyRoomURL is mill api to search device list by room
-	selectDevicebyRoomURL = baseURL + "uds/selectDevicebyRoom2020"
-	// selectHomeListURL is mill api to search housing list
-	selectHomeListURL = baseURL + "uds/selectHomeList"
-	// selectRoombyHomeURL is mill api to search room list by home
-	selectRoombyHomeURL = baseURL + "uds/selectRoombyHome2020"
+	// applyAccessTokenPath is mill api to get access_token and refresh_token
+	applyAccessTokenPath = "share/applyAccessToken"
+	// authPath is mill api to get authorization_code
+	authPath = "share/applyAuthCode"
+	// refreshPath is mill api to update access_token and refresh_token
+	refreshPath = "share/refreshtoken?refreshtoken="
+
+	// deviceControlPath is mill api to controll individual devices
+	deviceControlPath = "uds/deviceControlForOpenApi"
+	// getIndependentDevicesPath is mill api to get list of devices in unassigned room
+	getIndependentDevicesPath = "uds/getIndependentDevices2020"
+	// selectDevicebyRoomPath is mill api to search device list by room
+	selectDevicebyRoomPath = "uds/selectDevicebyRoom2020"
+	// selectHomeListPath is mill api to search housing list
+	selectHomeListPath = "uds/selectHomeList"
+	// selectRoombyHomePath is mill api to search room list by home
+	selectRoombyHomePath = "uds/selectRoombyHome2020"
 )
 
+// SetBaseURL changes the Mill api url. It must be called before the api is used.
+func SetBaseURL(url string) {
+	if url == "" {
+		url = DefaultBaseURL
+	}
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	baseURL = url
+}
+
+func apiURL(path string) string {
+	return baseURL + path
+}
+
 // Config is used to specify credential to Mill API
 // AccessKey : Access Key from api registration at http://api.millheat.com. Key is sent to mail.
 // SecretToken: Secret Token from api registration at http://api.millheat.com. Token is sent to mail.
@@ -64,6 +78,9 @@ type Config struct {
 type Client struct {
 	httpResponse *http.Response
 
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+
 	Data struct {
 		Homes              []Home   `json:"homeList"`
 		Rooms              []Room   `json:"roomList"`
@@ -79,6 +96,7 @@ type Device struct {
 	Tvoc                            int     `json:"tvoc"`
 	ShowBusinessLock                int     `json:"showBusinessLock"`
 	HeatingStatus                   int     `json:"heatingStatus"`
+	PowerStatus                     int     `json:"powerStatus"`
 	AmbientTemp                     float64 `json:"ambientTemp"`
 	WindowsStatus                   int     `json:"windowsStatus"`
 	TemperatureControlPermission    int     `json:"temperatureControlPermission"`
@@ -97,6 +115,15 @@ type Device struct {
 	Lock                            int     `json:"lock"`
 	Humidity                        int     `json:"humidity"`
 	ShowChildLock                   int     `json:"showChildLock"`
+
+	// Set by GetAllDevices from the home and room the device was listed in.
+	HomeID      int64  `json:"homeId,omitempty"`
+	HomeName    string `json:"homeName,omitempty"`
+	RoomID      int64  `json:"roomId,omitempty"`
+	RoomName    string `json:"roomName,omitempty"`
+	Independent bool   `json:"independent,omitempty"`
+	// AccountID is set by the adapter for devices of extra accounts.
+	AccountID string `json:"accountId,omitempty"`
 }
 
 type Home struct {
@@ -153,162 +180,181 @@ type Room struct {
 }
 
 // NewClient create a handle authentication to Mill API
-func (config *Config) NewClient(authCode string, password string, username string) (string, string, int64, int64) {
+func (config *Config) NewClient(authCode string, password string, username string) (string, string, int64, int64, error) {
+	if authCode == "" {
+		return "", "", 0, 0, ErrAuthCodeMissing
+	}
 	urlpassword := url.QueryEscape(password)
 	urlusername := url.QueryEscape(username)
-	url := applyAccessTokenURL + "?password=" + urlpassword + "&username=" + urlusername
+	url := apiURL(applyAccessTokenPath) + "?password=" + urlpassword + "&username=" + urlusername
 	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't post accessToken request, error: ", err))
+		log.Error(fmt.Errorf("Can't post accessToken request, error: %v", err))
+		return "", "", 0, 0, err
 	}
 	req.Header.Set("Accept", "*/*")
 	req.Header.Set("Authorization_code", authCode)
 
 	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, config)
+	if err = processHTTPResponse(resp, err, config); err != nil {
+		return "", "", 0, 0, err
+	}
+	if err = config.responseError(); err != nil {
+		return "", "", 0, 0, err
+	}
+	if config.Data.AccessToken == "" {
+		return "", "", 0, 0, fmt.Errorf("%w: no access token in response", ErrInvalidCredentials)
+	}
+	return config.Data.AccessToken, config.Data.RefreshToken, config.Data.ExpireTime, config.Data.RefreshExpireTime, nil
+}
 
-	accessToken := config.Data.AccessToken
-	refreshToken := config.Data.RefreshToken
-	expireTime := config.Data.ExpireTime
-	refreshExpireTime := config.Data.RefreshExpireTime
-	if err != nil {
-		return "", "", 0, 0
+// responseError returns an APIError if Mill responded with an error code.
+func (config *Config) responseError() error {
+	if config.ErrorCode == 0 {
+		return nil
 	}
-	defer resp.Body.Close()
-	return accessToken, refreshToken, expireTime, refreshExpireTime
+	return &APIError{StatusCode: config.StatusCode, ErrorCode: config.ErrorCode, Message: config.Message}
 }
 
+// RefreshToken gets new tokens with the refresh token. A refresh token Mill answers with an error code gives
+// ErrInvalidCredentials, since that is the only input of the request.
 func (config *Config) RefreshToken(refreshToken string) (string, string, int64, int64, error) {
-	url := fmt.Sprintf("%s%s", refreshURL, refreshToken)
+	url := fmt.Sprintf("%s%s", apiURL(refreshPath), refreshToken)
 	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't post refreshToken request, error: ", err))
+		log.Error(fmt.Errorf("Can't post refreshToken request, error: %v", err))
+		return "", "", 0, 0, err
 	}
 	req.Header.Set("Accept", "*/*")
 
 	resp, err := http.DefaultClient.Do(req)
-	if processHTTPResponse(resp, err, config) != nil {
-		return config.Data.AccessToken, config.Data.RefreshToken, config.Data.ExpireTime, config.Data.RefreshExpireTime, err
+	if err = processHTTPResponse(resp, err, config); err != nil {
+		return "", "", 0, 0, err
 	}
-
-	accessToken := config.Data.AccessToken
-	newRefreshToken := config.Data.RefreshToken
-	expireTime := config.Data.ExpireTime
-	refreshExpireTime := config.Data.RefreshExpireTime
-
-	defer resp.Body.Close()
-	return accessToken, newRefreshToken, expireTime, refreshExpireTime, nil
+	if err = config.responseError(); err != nil {
+		return "", "", 0, 0, fmt.Errorf("%w: refresh token rejected: %v", ErrInvalidCredentials, err)
+	}
+	if config.Data.AccessToken == "" {
+		return "", "", 0, 0, fmt.Errorf("%w: no access token in response", ErrInvalidCredentials)
+	}
+	return config.Data.AccessToken, config.Data.RefreshToken, config.Data.ExpireTime, config.Data.RefreshExpireTime, nil
 }
 
-func (c *Client) GetAllDevices(accessToken string) ([]Device, []Room, []Home, []Device, error) {
+// GetAllDevices lists all homes, and the rooms and devices of the homes accepted by includeHome. A nil includeHome
+// includes all homes.
+func (c *Client) GetAllDevices(accessToken string, includeHome func(homeID int64) bool) ([]Device, []Room, []Home, []Device, error) {
 	homes, err := c.GetHomeList(accessToken)
 	var allDevices []Device
 	var allRooms []Room
 	var allHomes []Home
 	var allIndependentDevices []Device
+	// firstErr is returned, so callers know the lists may be incomplete.
+	var firstErr error
 	if err != nil {
 		// handle err
-		log.Error(fmt.Errorf("Can't get home list, error: ", err))
-	}
-	for home := range homes.Data.Homes {
-		allHomes = append(allHomes, homes.Data.Homes[home])
-		rooms, err := c.GetRoomList(accessToken, homes.Data.Homes[home].HomeID)
+		log.Error(fmt.Errorf("Can't get home list, error: %v", err))
+		return nil, nil, nil, nil, err
+	}
+	// Each request replaces the response in c, so the lists are kept before the next request.
+	homeList := homes.Data.Homes
+	for home := range homeList {
+		allHomes = append(allHomes, homeList[home])
+		if includeHome != nil && !includeHome(homeList[home].HomeID) {
+			continue
+		}
+		rooms, err := c.GetRoomList(accessToken, homeList[home].HomeID)
 		if err != nil {
 			// handle err
-			log.Error(fmt.Errorf("Can't get room list, error: ", err))
-		}
-		for room := range rooms.Data.Rooms {
-			allRooms = append(allRooms, rooms.Data.Rooms[room])
-			devices, err := c.GetDeviceList(accessToken, rooms.Data.Rooms[room].RoomID)
-			for device := range devices.Data.Devices {
-				allDevices = append(allDevices, devices.Data.Devices[device])
+			log.Error(fmt.Errorf("Can't get room list, error: %v", err))
+			if firstErr == nil {
+				firstErr = err
 			}
+		}
+		roomList := rooms.Data.Rooms
+		for room := range roomList {
+			allRooms = append(allRooms, roomList[room])
+			devices, err := c.GetDeviceList(accessToken, roomList[room].RoomID)
 			if err != nil {
 				// handle err
-				log.Error(fmt.Errorf("Can't get device list, error: ", err))
+				log.Error(fmt.Errorf("Can't get device list, error: %v", err))
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			for device := range devices.Data.Devices {
+				d := devices.Data.Devices[device]
+				d.HomeID, d.HomeName = homeList[home].HomeID, homeList[home].HomeName
+				d.RoomID, d.RoomName = roomList[room].RoomID, roomList[room].RoomName
+				allDevices = append(allDevices, d)
 			}
 		}
 		// Get all independent devices
-		independentDevices, err := c.GetIndependentDevices(accessToken, homes.Data.Homes[home].HomeID)
+		independentDevices, err := c.GetIndependentDevices(accessToken, homeList[home].HomeID)
 		if err != nil {
 			// handle err
-			log.Error(fmt.Errorf("Can't get independent device list, error: ", err))
+			log.Error(fmt.Errorf("Can't get independent device list, error: %v", err))
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
 		for device := range independentDevices.Data.IndependentDevices {
-			allDevices = append(allDevices, independentDevices.Data.IndependentDevices[device])
-			allIndependentDevices = append(allIndependentDevices, independentDevices.Data.IndependentDevices[device])
+			d := independentDevices.Data.IndependentDevices[device]
+			d.HomeID, d.HomeName = homeList[home].HomeID, homeList[home].HomeName
+			d.Independent = true
+			allDevices = append(allDevices, d)
+			allIndependentDevices = append(allIndependentDevices, d)
 		}
 	}
-	return allDevices, allRooms, allHomes, allIndependentDevices, nil
+	return allDevices, allRooms, allHomes, allIndependentDevices, firstErr
 }
 
 // GetHomeList sends curl request to get list of homes connected to user
 func (c *Client) GetHomeList(accessToken string) (*Client, error) {
-	req, err := http.NewRequest("POST", selectHomeListURL, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't get home list, error: ", err))
-	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, c)
-
-	return c, nil
+	return c, c.list(apiURL(selectHomeListPath), accessToken)
 }
 
 // GetRoomList sends curl request to get list of rooms by home
 func (c *Client) GetRoomList(accessToken string, homeID int64) (*Client, error) {
-	url := fmt.Sprintf("%s%s%d", selectRoombyHomeURL, "?homeId=", homeID)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't get room list, error: ", err))
-	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, c)
-	return c, nil
+	url := fmt.Sprintf("%s%s%d", apiURL(selectRoombyHomePath), "?homeId=", homeID)
+	return c, c.list(url, accessToken)
 }
 
 // GetDeviceList sends curl request to get list of devices by room
 func (c *Client) GetDeviceList(accessToken string, roomID int64) (*Client, error) {
-	url := fmt.Sprintf("%s%s%d", selectDevicebyRoomURL, "?roomId=", roomID)
-	req, err := http.NewRequest("POST", url, nil)
-	if err != nil {
-		log.Error(fmt.Errorf("Can't get device list, error: ", err))
-		// handle err
-	}
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Access_token", accessToken)
-
-	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, c)
-	return c, nil
+	url := fmt.Sprintf("%s%s%d", apiURL(selectDevicebyRoomPath), "?roomId=", roomID)
+	return c, c.list(url, accessToken)
 }
 
 func (c *Client) GetIndependentDevices(accessToken string, homeId int64) (*Client, error) {
-	url := fmt.Sprintf("%s%s%d", getIndependentDevicesURL, "?homeId=", homeId)
+	url := fmt.Sprintf("%s%s%d", apiURL(getIndependentDevicesPath), "?homeId=", homeId)
+	return c, c.list(url, accessToken)
+}
+
+// list sends a list request and decodes the response into c, replacing the previous response. Mill answers an
+// invalid or expired access token with an error code and HTTP 200, which is returned as an APIError.
+func (c *Client) list(url string, accessToken string) error {
 	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't get independent device list, error: ", err))
+		return err
 	}
 	req.Header.Set("Accept", "*/*")
 	req.Header.Set("Access_token", accessToken)
 
+	c.ErrorCode, c.Message = 0, ""
+	c.Data.Homes, c.Data.Rooms, c.Data.Devices, c.Data.IndependentDevices = nil, nil, nil, nil
 	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, c)
-	return c, nil
+	if err = processHTTPResponse(resp, err, c); err != nil {
+		return err
+	}
+	if c.ErrorCode != 0 {
+		return &APIError{StatusCode: resp.StatusCode, ErrorCode: c.ErrorCode, Message: c.Message}
+	}
+	return nil
 }
 
 func (cf *Config) TempControl(accessToken string, deviceId string, newTemp string) error {
-	url := fmt.Sprintf("%s%s%s%s%s%s", deviceControlURL, "?deviceId=", deviceId, "&holdTemp=", newTemp, "&operation=1&status=1")
+	url := fmt.Sprintf("%s%s%s%s%s%s", apiURL(deviceControlPath), "?deviceId=", deviceId, "&holdTemp=", newTemp, "&operation=1&status=1")
 	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
 		return err
@@ -317,113 +363,77 @@ func (cf *Config) TempControl(accessToken string, deviceId string, newTemp strin
 	req.Header.Set("Access_token", accessToken)
 
 	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, cf)
-	if err != nil {
+	if err = processHTTPResponse(resp, err, cf); err != nil {
 		return err
 	}
 	log.Debug("url: ", url)
-	if cf.ErrorCode != 0 {
-		return fmt.Errorf("errorcode from request: %d", cf.ErrorCode)
-	}
-	return nil
+	return cf.responseError()
 }
 
-func (cf *Config) ModeControl(accessToken string, deviceId string, oldTemp int64, newMode string) bool {
+// ModeControl turns a heater on or off. holdTemp is the setpoint to keep, it is left out of the request if empty.
+func (cf *Config) ModeControl(accessToken string, deviceId string, holdTemp string, newMode string) error {
 	var mode int
 	if newMode == "heat" {
 		mode = 1
 	} else if newMode == "off" {
 		mode = 0
 	} else {
-		log.Info("Unsupported mode: ", newMode)
-		return false
+		return fmt.Errorf("unsupported mode: %s", newMode)
+	}
+	url := fmt.Sprintf("%s%s%s", apiURL(deviceControlPath), "?deviceId=", deviceId)
+	if holdTemp != "" {
+		url += "&holdTemp=" + holdTemp
 	}
-	url := fmt.Sprintf("%s%s%s%s%d%s%d", deviceControlURL, "?deviceId=", deviceId, "&holdTemp=", oldTemp, "&operation=0&status=", mode)
+	url += fmt.Sprintf("%s%d", "&operation=0&status=", mode)
 	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
-		// handle err
-		log.Error(fmt.Errorf("Can't controll device, error: ", err))
+		return err
 	}
 	req.Header.Set("Accept", "*/*")
 	req.Header.Set("Access_token", accessToken)
 
 	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, cf)
-	if err != nil {
+	if err = processHTTPResponse(resp, err, cf); err != nil {
 		log.Debug("Error in DeviceControl: ", err)
+		return err
 	}
-
-	if cf.ErrorCode == 0 {
-		return true
-	}
-	return false
+	return cf.responseError()
 }
 
-func (cf *Config) GetAuthCode(oldMsg *fimpgo.Message) (string, string) {
-	cfs := model.Configs{}
-	val, err := oldMsg.Payload.GetStrMapValue()
-	if err != nil {
-		log.Error("Wrong msg format")
-		return "", ""
-	}
-	cfs.HubToken = val["token"]
-
-	type Payload struct {
-		PartnerCode string `json:"partnerCode"`
+// SwitchControl turns a socket on or off.
+func (cf *Config) SwitchControl(accessToken string, deviceId string, on bool) error {
+	status := 0
+	if on {
+		status = 1
 	}
-	data := Payload{
-		PartnerCode: "mill",
-	}
-	payloadBytes, err := json.Marshal(data)
+	url := fmt.Sprintf("%s%s%s%s%d", apiURL(deviceControlPath), "?deviceId=", deviceId, "&operation=0&status=", status)
+	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
-		// handle err
-		log.Debug("issue with payloadBytes")
-	}
-	body := bytes.NewReader(payloadBytes)
-
-	var env string
-	hubInfo, err := utils.NewHubUtils().GetHubInfo()
-	if err == nil && hubInfo != nil {
-		env = hubInfo.Environment
-	} else {
-		// TODO: switch to prod
-		env = utils.EnvBeta
-	}
-	var url string
-	if env == utils.EnvBeta {
-		url = "https://partners-beta.futurehome.io/api/control/edge/proxy/custom/auth-code"
-	} else {
-		url = "https://partners.futurehome.io/api/control/edge/proxy/custom/auth-code"
+		return err
 	}
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("Access_token", accessToken)
 
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		// handle err
-		log.Debug(fmt.Errorf("Issue when making request to partner-api"))
-	}
-	req.Header.Set("Authorization", os.ExpandEnv(fmt.Sprintf("%s%s", "Bearer ", cfs.HubToken)))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Postman-Token", "65cb80d3-cbd2-4c8d-954a-bb3253b306e5")
-	req.Header.Set("Cache-Control", "no-cache")
 	resp, err := http.DefaultClient.Do(req)
-	processHTTPResponse(resp, err, cf)
-
-	authorizationCode := cf.Data.AuthorizationCode
-	return authorizationCode, cfs.HubToken
+	if err = processHTTPResponse(resp, err, cf); err != nil {
+		log.Debug("Error in SwitchControl: ", err)
+		return err
+	}
+	return cf.responseError()
 }
 
 // Unmarshall received data into holder struct
 func processHTTPResponse(resp *http.Response, err error, holder interface{}) error {
 	if err != nil {
 		log.Error(fmt.Errorf("API does not respond"))
-		return err
+		return fmt.Errorf("%w: %v", ErrUnreachable, err)
 	}
 	defer resp.Body.Close()
 	// check http return code
 	if resp.StatusCode != 200 {
 		//bytes, _ := ioutil.ReadAll(resp.Body)
 		log.Error("Bad HTTP return code ", resp.StatusCode)
-		return fmt.Errorf("Bad HTTP return code %d", resp.StatusCode)
+		return &APIError{StatusCode: resp.StatusCode}
 	}
 
 	// Unmarshall response into given struct
@@ -433,11 +443,12 @@ func processHTTPResponse(resp *http.Response, err error, holder interface{}) err
 	return nil
 }
 
-func (c *Client) UpdateLists(accessToken string, hc []interface{}, rc []interface{}, dc []interface{}, idc []interface{}) (homelist []interface{}, roomlist []interface{}, devicelist []interface{}, independentdevicelist []interface{}) {
-	allDevices, allRooms, allHomes, allIndependentDevices, err := c.GetAllDevices(accessToken)
+// UpdateLists appends homes, rooms and devices to the given lists. The lists may be incomplete if err is not nil.
+func (c *Client) UpdateLists(accessToken string, hc []interface{}, rc []interface{}, dc []interface{}, idc []interface{}, includeHome func(homeID int64) bool) (homelist []interface{}, roomlist []interface{}, devicelist []interface{}, independentdevicelist []interface{}, err error) {
+	allDevices, allRooms, allHomes, allIndependentDevices, err := c.GetAllDevices(accessToken, includeHome)
 	if err != nil {
 		// handle err
-		log.Error(fmt.Errorf("Can't update lists, error: ", err))
+		log.Error(fmt.Errorf("Can't update lists, error: %v", err))
 	}
 	for home := range allHomes {
 		hc = append(hc, allHomes[home])
@@ -451,5 +462,5 @@ func (c *Client) UpdateLists(accessToken string, hc []interface{}, rc []interfac
 	for device := range allIndependentDevices {
 		idc = append(idc, allIndependentDevices[device])
 	}
-	return hc, rc, dc, idc
+	return hc, rc, dc, idc, err
 }
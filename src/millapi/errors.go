@@ -0,0 +1,51 @@
+package mill
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrUnreachable is returned when the Mill API can't be reached or fails on its side.
+	// Commands failing with this error are worth retrying later.
+	ErrUnreachable = errors.New("mill api is unreachable")
+	// ErrRateLimited is returned when Mill rejects a request because of too many requests.
+	ErrRateLimited = errors.New("too many requests to mill api")
+	// ErrInvalidCredentials is returned when Mill rejects username, password or developer credentials.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrAuthCodeMissing is returned when there is no authorization code to exchange for tokens.
+	ErrAuthCodeMissing = errors.New("authorization code is missing")
+	// ErrPartnerAPI is returned when the Futurehome partner API fails to provide an authorization code.
+	ErrPartnerAPI = errors.New("partner api failed")
+	// ErrMillAPI is returned when Mill responds with an error code. Mill's open API doesn't document what its error
+	// codes mean, so they aren't mapped to more specific errors.
+	ErrMillAPI = errors.New("mill api returned an error")
+)
+
+// APIError is an error response from Mill or the partner API. It unwraps to ErrUnreachable, ErrRateLimited or
+// ErrInvalidCredentials when the HTTP status tells which of them it is, otherwise to ErrMillAPI.
+type APIError struct {
+	StatusCode int
+	ErrorCode  int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.ErrorCode != 0 {
+		return fmt.Sprintf("errorcode from request: %d, %s", e.ErrorCode, e.Message)
+	}
+	return fmt.Sprintf("Bad HTTP return code %d", e.StatusCode)
+}
+
+func (e *APIError) Unwrap() error {
+	switch {
+	case e.StatusCode >= 500:
+		return ErrUnreachable
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return ErrInvalidCredentials
+	}
+	return ErrMillAPI
+}
@@ -0,0 +1,116 @@
+package model
+
+import (
+	"strconv"
+
+	"github.com/futurehomeno/edge-mill-adapter/utils"
+)
+
+// PrimaryAccountID is the account logged in with cmd.auth.login. Its tokens are kept in Configs.Auth and its
+// devices are addressed by their plain Mill device id.
+const PrimaryAccountID = "1"
+
+// Account is an extra Mill user added with cmd.auth.add_account. Each account has its own tokens and devices.
+type Account struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	AuthState string     `json:"auth_state"`
+	Auth      AuthTokens `json:"auth"`
+	// Credentials are kept in the secret store, see AccountSecrets.
+	Username string `json:"-"`
+	Password string `json:"-"`
+}
+
+// AccountSecrets are the credentials and tokens of an extra account.
+type AccountSecrets struct {
+	AuthorizationCode string `json:"authorization_code"`
+	AccessToken       string `json:"access_token"`
+	RefreshToken      string `json:"refresh_token"`
+	Username          string `json:"username"`
+	Password          string `json:"password"`
+}
+
+// secretPrefix namespaces the log secrets of an account, so they don't replace those of other accounts.
+func secretPrefix(accountID string) string {
+	return "account/" + accountID + "/"
+}
+
+func (s AccountSecrets) register(accountID string) {
+	registerSecrets(secretPrefix(accountID), map[string]string{
+		"authorization_code": s.AuthorizationCode,
+		"access_token":       s.AccessToken,
+		"refresh_token":      s.RefreshToken,
+		"username":           s.Username,
+		"password":           s.Password,
+	})
+}
+
+// GetAccounts returns a copy of the extra accounts.
+func (cf *Configs) GetAccounts() []Account {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return append([]Account{}, cf.Accounts...)
+}
+
+func (cf *Configs) GetAccount(id string) (Account, bool) {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	for _, account := range cf.Accounts {
+		if account.ID == id {
+			return account, true
+		}
+	}
+	return Account{}, false
+}
+
+// AddAccount adds an extra account with the next free id.
+func (cf *Configs) AddAccount(name string, username string, password string) Account {
+	cf.mux.Lock()
+	defer cf.mux.Unlock()
+	next := 2
+	for _, account := range cf.Accounts {
+		if id, err := strconv.Atoi(account.ID); err == nil && id >= next {
+			next = id + 1
+		}
+	}
+	account := Account{ID: strconv.Itoa(next), Name: name, AuthState: string(AuthStateNotAuthenticated), Username: username, Password: password}
+	cf.Accounts = append(cf.Accounts, account)
+	AccountSecrets{Username: username, Password: password}.register(account.ID)
+	return account
+}
+
+// UpdateAccount replaces the stored account with the same id. It returns false if the account has been removed.
+func (cf *Configs) UpdateAccount(account Account) bool {
+	cf.mux.Lock()
+	defer cf.mux.Unlock()
+	for i := range cf.Accounts {
+		if cf.Accounts[i].ID == account.ID {
+			cf.Accounts[i] = account
+			AccountSecrets{AuthorizationCode: account.Auth.AuthorizationCode, AccessToken: account.Auth.AccessToken, RefreshToken: account.Auth.RefreshToken}.register(account.ID)
+			return true
+		}
+	}
+	return false
+}
+
+func (cf *Configs) RemoveAccount(id string) bool {
+	cf.mux.Lock()
+	defer cf.mux.Unlock()
+	for i := range cf.Accounts {
+		if cf.Accounts[i].ID == id {
+			cf.Accounts = append(cf.Accounts[:i], cf.Accounts[i+1:]...)
+			utils.RemoveSecrets(secretPrefix(id))
+			return true
+		}
+	}
+	return false
+}
+
+// AccessTokenFor returns the access token of the account owning a device address.
+func (cf *Configs) AccessTokenFor(accountID string) string {
+	if accountID == PrimaryAccountID {
+		return cf.GetAccessToken()
+	}
+	account, _ := cf.GetAccount(accountID)
+	return account.Auth.AccessToken
+}
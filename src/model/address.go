@@ -0,0 +1,78 @@
+package model
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidAddress is returned for service addresses that don't name a Mill device.
+	ErrInvalidAddress = errors.New("invalid device address")
+	// ErrDeviceNotFound is returned for valid addresses of devices not in the device list.
+	ErrDeviceNotFound = errors.New("device not found")
+)
+
+const (
+	// accountSeparator separates account id and Mill device id in the address of devices from extra accounts.
+	accountSeparator = "-"
+	// legacyPrefix and legacySuffix were part of service addresses in older versions and are still accepted.
+	legacyPrefix = "l"
+	legacySuffix = "_0"
+)
+
+// DeviceAddr identifies a Mill device of an account. Its string form is the FIMP service address.
+type DeviceAddr struct {
+	AccountID string
+	DeviceID  int64
+}
+
+// String encodes the address. Devices of the primary account are addressed by their Mill device id, devices of
+// extra accounts are prefixed with the account id.
+func (a DeviceAddr) String() string {
+	id := strconv.FormatInt(a.DeviceID, 10)
+	if a.AccountID == "" || a.AccountID == PrimaryAccountID {
+		return id
+	}
+	return a.AccountID + accountSeparator + id
+}
+
+// MillID is the device id used in Mill API requests.
+func (a DeviceAddr) MillID() string {
+	return strconv.FormatInt(a.DeviceID, 10)
+}
+
+// ParseDeviceAddress decodes a FIMP service address. Legacy addresses like "l123_0" are accepted.
+func ParseDeviceAddress(addr string) (DeviceAddr, error) {
+	addr = strings.TrimSuffix(addr, legacySuffix)
+	accountID, deviceID := PrimaryAccountID, addr
+	if i := strings.Index(addr, accountSeparator); i >= 0 {
+		accountID, deviceID = addr[:i], addr[i+len(accountSeparator):]
+		if _, err := strconv.Atoi(accountID); err != nil {
+			return DeviceAddr{}, ErrInvalidAddress
+		}
+	} else {
+		deviceID = strings.TrimPrefix(deviceID, legacyPrefix)
+	}
+	id, err := strconv.ParseInt(deviceID, 10, 64)
+	if err != nil || id <= 0 {
+		return DeviceAddr{}, ErrInvalidAddress
+	}
+	return DeviceAddr{AccountID: accountID, DeviceID: id}, nil
+}
+
+// DeviceAddress encodes the FIMP address of a Mill device.
+func DeviceAddress(accountID string, deviceID int64) string {
+	return DeviceAddr{AccountID: accountID, DeviceID: deviceID}.String()
+}
+
+// DeviceAddressOf returns the FIMP address of a device from the device list.
+func DeviceAddressOf(device interface{}) string {
+	val := reflect.ValueOf(device)
+	accountID := ""
+	if account := val.FieldByName("AccountID"); account.IsValid() {
+		accountID = account.String()
+	}
+	return DeviceAddress(accountID, val.FieldByName("DeviceID").Interface().(int64))
+}
@@ -16,8 +16,21 @@ type SetTokens struct {
 	// Scope             string `json:"scope"`
 }
 
+// Error codes in AuthStatus.
+const (
+	AuthErrorNetwork            = "NETWORK_ERROR"
+	AuthErrorRateLimited        = "RATE_LIMITED"
+	AuthErrorInvalidCredentials = "INVALID_CREDENTIALS"
+	AuthErrorAuthCodeMissing    = "AUTH_CODE_MISSING"
+	AuthErrorPartnerAPI         = "PARTNER_API_ERROR"
+	AuthErrorMillAPI            = "MILL_API_ERROR"
+)
+
+// AuthStatus is the value of evt.auth.status_report.
 type AuthStatus struct {
 	Status    string `json:"status"`
 	ErrorText string `json:"error_text"`
 	ErrorCode string `json:"error_code"`
+	// Account is set for extra accounts, see Account.
+	Account string `json:"account,omitempty"`
 }
@@ -0,0 +1,224 @@
+package model
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/futurehomeno/edge-mill-adapter/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultCommandTTL is how long a queued command is kept before it expires.
+const DefaultCommandTTL = time.Hour
+
+// QueuedCommand is a control command that couldn't be delivered to the Mill cloud and waits for replay.
+type QueuedCommand struct {
+	ID        int64             `json:"id"`
+	DeviceID  string            `json:"device_id"`
+	Service   string            `json:"service"`
+	Type      string            `json:"type"`
+	Value     map[string]string `json:"value"`
+	QueuedAt  int64             `json:"queued_at"`
+	ExpiresAt int64             `json:"expires_at"`
+	Attempts  int               `json:"attempts"`
+}
+
+// IsExpired returns true if the command is too old to be replayed.
+func (qc *QueuedCommand) IsExpired(now time.Time) bool {
+	return now.Unix() > qc.ExpiresAt
+}
+
+// CommandQueue is a persistent FIFO queue of failed control commands.
+// Only one command is kept per device.
+type CommandQueue struct {
+	path     string
+	mux      sync.Mutex
+	Commands []QueuedCommand `json:"commands"`
+}
+
+func NewCommandQueue(workDir string) *CommandQueue {
+	return &CommandQueue{path: filepath.Join(workDir, "data", "command_queue.json")}
+}
+
+func (cq *CommandQueue) LoadFromFile() error {
+	cq.mux.Lock()
+	defer cq.mux.Unlock()
+	if !utils.FileExists(cq.path) && !utils.FileExists(utils.BackupPath(cq.path)) {
+		log.Debug("<queue> Queue file doesn't exist. Starting with empty queue")
+		return nil
+	}
+	_, err := loadJSONFile(cq.path, cq, nil)
+	return err
+}
+
+// saveToFile must be called with mux held.
+func (cq *CommandQueue) saveToFile() error {
+	bpayload, err := json.Marshal(cq)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(cq.path, bpayload, 0664)
+}
+
+// Add appends cmd to the end of the queue, replacing an older command for the same device. Mill sets mode and
+// setpoint of a heater in one request, so an older mode or setpoint is merged into the newer command.
+func (cq *CommandQueue) Add(cmd QueuedCommand) error {
+	cq.mux.Lock()
+	defer cq.mux.Unlock()
+	now := time.Now()
+	cmd.ID = now.UnixNano()
+	cmd.QueuedAt = now.Unix()
+	cmd.ExpiresAt = now.Add(DefaultCommandTTL).Unix()
+	for i := range cq.Commands {
+		if cq.Commands[i].DeviceID == cmd.DeviceID {
+			log.Debugf("<queue> Replacing queued %s for device %s with %s", cq.Commands[i].Type, cmd.DeviceID, cmd.Type)
+			cmd = mergeCommands(cq.Commands[i], cmd)
+			cq.Commands = append(cq.Commands[:i], cq.Commands[i+1:]...)
+			break
+		}
+	}
+	cq.Commands = append(cq.Commands, cmd)
+	return cq.saveToFile()
+}
+
+// Peek returns the oldest command in the queue without removing it.
+func (cq *CommandQueue) Peek() (QueuedCommand, bool) {
+	cq.mux.Lock()
+	defer cq.mux.Unlock()
+	if len(cq.Commands) == 0 {
+		return QueuedCommand{}, false
+	}
+	return cq.Commands[0], true
+}
+
+// Remove deletes the command with the given id. It is a no-op if the command has been replaced in the meantime.
+func (cq *CommandQueue) Remove(id int64) error {
+	cq.mux.Lock()
+	defer cq.mux.Unlock()
+	for i := range cq.Commands {
+		if cq.Commands[i].ID == id {
+			cq.Commands = append(cq.Commands[:i], cq.Commands[i+1:]...)
+			return cq.saveToFile()
+		}
+	}
+	return nil
+}
+
+// Contains returns true if the command with the given id is still queued.
+func (cq *CommandQueue) Contains(id int64) bool {
+	cq.mux.Lock()
+	defer cq.mux.Unlock()
+	for i := range cq.Commands {
+		if cq.Commands[i].ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivered removes the values set by a delivered command from the older queued command of the same device, so
+// they aren't overwritten when the queue is replayed. The queued command is dropped if nothing is left of it.
+func (cq *CommandQueue) Delivered(cmd QueuedCommand) error {
+	cq.mux.Lock()
+	defer cq.mux.Unlock()
+	for i := range cq.Commands {
+		if cq.Commands[i].DeviceID != cmd.DeviceID {
+			continue
+		}
+		value := map[string]string{}
+		for key, val := range cq.Commands[i].Value {
+			if _, set := cmd.Value[key]; !set {
+				value[key] = val
+			}
+		}
+		cmdType := thermostatCommandType(value)
+		if cmdType == "" || cq.Commands[i].Service != cmd.Service {
+			cq.Commands = append(cq.Commands[:i], cq.Commands[i+1:]...)
+		} else {
+			cq.Commands[i].Type = cmdType
+			cq.Commands[i].Value = value
+		}
+		return cq.saveToFile()
+	}
+	return nil
+}
+
+// mergeCommands combines a queued command with a newer one for the same device. Values of the older command that
+// the newer one doesn't set are kept for thermostats, where mode and setpoint are sent together.
+func mergeCommands(older QueuedCommand, newer QueuedCommand) QueuedCommand {
+	if older.Service != "thermostat" || newer.Service != "thermostat" {
+		return newer
+	}
+	value := map[string]string{}
+	for key, val := range older.Value {
+		value[key] = val
+	}
+	for key, val := range newer.Value {
+		value[key] = val
+	}
+	newer.Value = value
+	newer.Type = thermostatCommandType(value)
+	return newer
+}
+
+// thermostatCommandType returns the command delivering a thermostat value: cmd.mode.set, which also takes the
+// setpoint, if it has a mode, cmd.setpoint.set if it only has a setpoint, and "" if it has neither.
+func thermostatCommandType(value map[string]string) string {
+	if _, ok := value["mode"]; ok {
+		return "cmd.mode.set"
+	}
+	if _, ok := value["temp"]; ok {
+		return "cmd.setpoint.set"
+	}
+	return ""
+}
+
+// MarkAttempt increases the attempt counter of the command with the given id.
+func (cq *CommandQueue) MarkAttempt(id int64) {
+	cq.mux.Lock()
+	defer cq.mux.Unlock()
+	for i := range cq.Commands {
+		if cq.Commands[i].ID == id {
+			cq.Commands[i].Attempts++
+			cq.saveToFile()
+			return
+		}
+	}
+}
+
+// RemoveExpired drops all expired commands and returns them.
+func (cq *CommandQueue) RemoveExpired(now time.Time) []QueuedCommand {
+	cq.mux.Lock()
+	defer cq.mux.Unlock()
+	var expired []QueuedCommand
+	active := cq.Commands[:0]
+	for _, cmd := range cq.Commands {
+		if cmd.IsExpired(now) {
+			expired = append(expired, cmd)
+		} else {
+			active = append(active, cmd)
+		}
+	}
+	cq.Commands = active
+	if len(expired) > 0 {
+		cq.saveToFile()
+	}
+	return expired
+}
+
+// Clear drops all queued commands.
+func (cq *CommandQueue) Clear() error {
+	cq.mux.Lock()
+	defer cq.mux.Unlock()
+	cq.Commands = nil
+	return cq.saveToFile()
+}
+
+// Len returns number of queued commands.
+func (cq *CommandQueue) Len() int {
+	cq.mux.Lock()
+	defer cq.mux.Unlock()
+	return len(cq.Commands)
+}
@@ -3,9 +3,10 @@ package model
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/futurehomeno/edge-mill-adapter/utils"
@@ -15,8 +16,22 @@ import (
 
 const ServiceName = "mill"
 
+const (
+	// AuthProviderPartner gets the authorization code through the Futurehome partner API using a hub token.
+	AuthProviderPartner = "partner"
+	// AuthProviderMillKey gets the authorization code directly from Mill using developer credentials.
+	AuthProviderMillKey = "mill_key"
+	// AuthProviderStatic uses StaticAuthCode. It is meant for tests against a local server.
+	AuthProviderStatic = "static"
+)
+
+// Configs is safe for concurrent use when accessed through its methods.
 type Configs struct {
 	path               string
+	mux                sync.RWMutex
+	saveMux            sync.Mutex
+	secrets            *SecretStore
+	SchemaVersion      int    `json:"schema_version"`
 	InstanceAddress    string `json:"instance_address"`
 	MqttServerURI      string `json:"mqtt_server_uri"`
 	MqttUsername       string `json:"mqtt_server_username"`
@@ -31,31 +46,68 @@ type Configs struct {
 	Param1             bool   `json:"param_1"`
 	Param2             string `json:"param_2"`
 	PollTimeMin        string `json:"poll_time_min"`
+	// AutoRelogin keeps the credentials in the secret store after login, so the adapter can log in again by itself
+	// when the refresh token expires.
+	AutoRelogin bool `json:"auto_relogin"`
+	// KeepFuturehomeNames stops devices renamed in the Mill app from being renamed in Futurehome.
+	KeepFuturehomeNames bool `json:"keep_futurehome_names"`
+	// SelectedHomes are the ids of the Mill homes whose devices are polled, included and controlled. All homes are
+	// used when empty.
+	SelectedHomes []string `json:"selected_homes"`
 
-	Username string `json:"username"` // this should be moved
-	Password string `json:"password"` // this should be moved
+	RouterWorkers         int    `json:"router_workers"`
+	RouterQueueSize       int    `json:"router_queue_size"`
+	RouterQueueFullPolicy string `json:"router_queue_full_policy"` // block, drop_newest or drop_oldest
 
-	Auth struct {
-		AuthorizationCode string `json:"authorization_code"` // this should be moved
-		AccessToken       string `json:"access_token"`       // this should be moved
-		RefreshToken      string `json:"refresh_token"`      // this should be moved
-		ExpireTime        int64  `json:"expireTime"`         // this should be moved
-		RefreshExpireTime int64  `json:"refresh_expireTime"` // this should be moved
-	}
+	// AuthProvider selects how the Mill authorization code is fetched, see AuthProviderPartner, AuthProviderMillKey
+	// and AuthProviderStatic.
+	AuthProvider   string `json:"auth_provider"`
+	StaticAuthCode string `json:"static_auth_code"`
+	// PartnerAuthURL and MillBaseURL override the default Futurehome partner API and Mill API urls.
+	PartnerAuthURL string `json:"partner_auth_url"`
+	MillBaseURL    string `json:"mill_base_url"`
+
+	// SecretKeyFile is the hub secret the secret store key is derived from. Defaults to secret.key in the data dir.
+	SecretKeyFile string `json:"secret_key_file"`
+	// LegacySecrets holds secrets found in config.json written by older versions until they are moved to the secret store.
+	LegacySecrets *Secrets `json:"legacy_secrets,omitempty"`
+
+	// Credentials and tokens are kept in the secret store, see SecretStore.
+	Username string `json:"-"`
+	Password string `json:"-"`
+	// MillAccessKey and MillSecretToken are developer credentials from api.millheat.com, used by AuthProviderMillKey.
+	MillAccessKey   string `json:"-"`
+	MillSecretToken string `json:"-"`
+
+	Auth AuthTokens
+	// Accounts are extra Mill users, see Account. Their credentials and tokens are kept in the secret store.
+	Accounts []Account `json:"accounts"`
 
 	ConnectionState string `json:"connection_state"`
 	Errors          string `json:"errors"`
-	HubToken        string `json:"token"`
+	HubToken        string `json:"-"`
 	UID             string `json:"uid"`
 }
 
+// AuthTokens is the token set received from Mill. Only expire times are stored in config.json.
+type AuthTokens struct {
+	AuthorizationCode string `json:"-"`
+	AccessToken       string `json:"-"`
+	RefreshToken      string `json:"-"`
+	ExpireTime        int64  `json:"expireTime"`
+	RefreshExpireTime int64  `json:"refresh_expireTime"`
+}
+
+// configsJSON has the fields of Configs without its methods, so it can be marshalled while the lock is held.
+type configsJSON Configs
+
 func NewConfigs(workDir string) *Configs {
 	conf := &Configs{WorkDir: workDir}
 	conf.path = filepath.Join(workDir, "data", "config.json")
 	if !utils.FileExists(conf.path) {
 		log.Info("Config file doesn't exist.Loading default config")
 		defaultConfigFile := filepath.Join(workDir, "defaults", "config.json")
-		err := utils.CopyFile(defaultConfigFile, conf.path)
+		err := restoreFile(conf.path, defaultConfigFile)
 		if err != nil {
 			fmt.Print(err)
 			panic("Can't copy config file.")
@@ -64,27 +116,399 @@ func NewConfigs(workDir string) *Configs {
 	return conf
 }
 
+// LoadFromFile loads configs and secrets, upgrading the file to the current schema version if it was written by an older version.
 func (cf *Configs) LoadFromFile() error {
-	configFileBody, err := ioutil.ReadFile(cf.path)
+	cf.mux.Lock()
+	migrated, err := loadJSONFile(cf.path, (*configsJSON)(cf), configMigrations)
 	if err != nil {
+		cf.mux.Unlock()
 		return err
 	}
-	err = json.Unmarshal(configFileBody, cf)
+	legacySecrets := cf.LegacySecrets
+	movedSecrets := legacySecrets != nil
+	err = cf.loadSecrets()
+	cf.mux.Unlock()
 	if err != nil {
 		return err
 	}
+	if !migrated && !movedSecrets {
+		return nil
+	}
+	if err = cf.SaveToFile(); err != nil || !movedSecrets {
+		if err != nil && movedSecrets {
+			// Credentials stay in config.json until they are in the secret store.
+			cf.mux.Lock()
+			cf.LegacySecrets = legacySecrets
+			cf.mux.Unlock()
+			cf.SaveToFile()
+		}
+		return err
+	}
+	// Save once more, so the backup generation doesn't keep credentials in plain text.
+	return cf.SaveToFile()
+}
+
+// loadSecrets must be called with mux held.
+func (cf *Configs) loadSecrets() error {
+	keyFile := cf.SecretKeyFile
+	if keyFile == "" {
+		keyFile = filepath.Join(cf.WorkDir, "data", "secret.key")
+	}
+	cf.secrets = NewSecretStore(filepath.Join(cf.WorkDir, "data", "secrets.enc"), keyFile)
+	secrets, err := cf.secrets.Load()
+	if err != nil {
+		return err
+	}
+	if cf.LegacySecrets != nil {
+		log.Info("<secrets> Moving credentials from config file to secret store")
+		mergeSecrets(&secrets, *cf.LegacySecrets)
+		cf.LegacySecrets = nil
+	}
+	secrets.register()
+	utils.SetSecret("mqtt_password", cf.MqttPassword)
+	cf.Auth.AuthorizationCode = secrets.AuthorizationCode
+	cf.Auth.AccessToken = secrets.AccessToken
+	cf.Auth.RefreshToken = secrets.RefreshToken
+	cf.HubToken = secrets.HubToken
+	cf.Username = secrets.Username
+	cf.Password = secrets.Password
+	cf.MillAccessKey = secrets.MillAccessKey
+	cf.MillSecretToken = secrets.MillSecretToken
+	for i := range cf.Accounts {
+		account := secrets.Accounts[cf.Accounts[i].ID]
+		cf.Accounts[i].Auth.AuthorizationCode = account.AuthorizationCode
+		cf.Accounts[i].Auth.AccessToken = account.AccessToken
+		cf.Accounts[i].Auth.RefreshToken = account.RefreshToken
+		cf.Accounts[i].Username = account.Username
+		cf.Accounts[i].Password = account.Password
+	}
 	return nil
 }
 
+// mergeSecrets fills empty values in dst from src.
+func mergeSecrets(dst *Secrets, src Secrets) {
+	if dst.AuthorizationCode == "" {
+		dst.AuthorizationCode = src.AuthorizationCode
+	}
+	if dst.AccessToken == "" {
+		dst.AccessToken = src.AccessToken
+	}
+	if dst.RefreshToken == "" {
+		dst.RefreshToken = src.RefreshToken
+	}
+	if dst.HubToken == "" {
+		dst.HubToken = src.HubToken
+	}
+	if dst.Username == "" {
+		dst.Username = src.Username
+	}
+	if dst.Password == "" {
+		dst.Password = src.Password
+	}
+}
+
 func (cf *Configs) SaveToFile() error {
+	cf.saveMux.Lock()
+	defer cf.saveMux.Unlock()
+	cf.mux.Lock()
 	cf.ConfiguredBy = "auto"
 	cf.ConfiguredAt = time.Now().Format(time.RFC3339)
-	bpayload, err := json.Marshal(cf)
-	err = ioutil.WriteFile(cf.path, bpayload, 0664)
+	cf.SchemaVersion = ConfigSchemaVersion
+	bpayload, err := json.Marshal((*configsJSON)(cf))
+	secrets := Secrets{
+		AuthorizationCode: cf.Auth.AuthorizationCode,
+		AccessToken:       cf.Auth.AccessToken,
+		RefreshToken:      cf.Auth.RefreshToken,
+		HubToken:          cf.HubToken,
+		Username:          cf.Username,
+		Password:          cf.Password,
+		MillAccessKey:     cf.MillAccessKey,
+		MillSecretToken:   cf.MillSecretToken,
+	}
+	for _, account := range cf.Accounts {
+		if secrets.Accounts == nil {
+			secrets.Accounts = map[string]AccountSecrets{}
+		}
+		secrets.Accounts[account.ID] = AccountSecrets{
+			AuthorizationCode: account.Auth.AuthorizationCode,
+			AccessToken:       account.Auth.AccessToken,
+			RefreshToken:      account.Auth.RefreshToken,
+			Username:          account.Username,
+			Password:          account.Password,
+		}
+	}
+	store := cf.secrets
+	cf.mux.Unlock()
+	secrets.register()
 	if err != nil {
 		return err
 	}
-	return err
+	// Secrets go first. config.json is written even if the secret store fails, so other settings aren't lost, and
+	// the store error is returned after it.
+	var storeErr error
+	if store != nil && secrets.isEmpty() {
+		// Nothing to keep, e.g. after logout. Don't leave an encrypted file or a backup generation behind.
+		if storeErr = store.Wipe(); storeErr != nil {
+			log.Error("<secrets> Can't wipe secret store. Error: ", storeErr)
+		}
+	} else if store != nil {
+		if storeErr = store.Save(secrets); storeErr != nil {
+			log.Error("<secrets> Can't save secret store. Error: ", storeErr)
+		}
+	}
+	if err = utils.WriteFileAtomic(cf.path, bpayload, 0664); err != nil {
+		return err
+	}
+	return storeErr
+}
+
+// MarshalJSON takes a read lock, so configs can be sent in reports while other goroutines update them. The MQTT
+// password is left out, since reports must not contain secrets. config.json is written by SaveToFile instead.
+func (cf *Configs) MarshalJSON() ([]byte, error) {
+	cf.mux.RLock()
+	bpayload, err := json.Marshal((*configsJSON)(cf))
+	cf.mux.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	report := map[string]json.RawMessage{}
+	if err = json.Unmarshal(bpayload, &report); err != nil {
+		return nil, err
+	}
+	delete(report, "mqtt_server_password")
+	return json.Marshal(report)
+}
+
+func (cf *Configs) GetAuth() AuthTokens {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return cf.Auth
+}
+
+func (cf *Configs) SetAuth(auth AuthTokens) {
+	cf.mux.Lock()
+	cf.Auth = auth
+	cf.mux.Unlock()
+	Secrets{AuthorizationCode: auth.AuthorizationCode, AccessToken: auth.AccessToken, RefreshToken: auth.RefreshToken}.register()
+}
+
+func (cf *Configs) GetAccessToken() string {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return cf.Auth.AccessToken
+}
+
+// SetAuthCode stores the authorization code and the hub token used to get it.
+func (cf *Configs) SetAuthCode(authCode string, hubToken string) {
+	cf.mux.Lock()
+	cf.Auth.AuthorizationCode = authCode
+	cf.HubToken = hubToken
+	cf.mux.Unlock()
+	Secrets{AuthorizationCode: authCode, HubToken: hubToken}.register()
+}
+
+// GetAuthProvider returns the configured auth provider, AuthProviderPartner if none is set.
+func (cf *Configs) GetAuthProvider() string {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	switch cf.AuthProvider {
+	case AuthProviderMillKey, AuthProviderStatic:
+		return cf.AuthProvider
+	}
+	return AuthProviderPartner
+}
+
+// AuthSettings holds what is needed to build the auth code provider.
+type AuthSettings struct {
+	Provider        string
+	PartnerAuthURL  string
+	MillAccessKey   string
+	MillSecretToken string
+	StaticAuthCode  string
+}
+
+func (cf *Configs) GetAuthSettings() AuthSettings {
+	provider := cf.GetAuthProvider()
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return AuthSettings{
+		Provider:        provider,
+		PartnerAuthURL:  cf.PartnerAuthURL,
+		MillAccessKey:   cf.MillAccessKey,
+		MillSecretToken: cf.MillSecretToken,
+		StaticAuthCode:  cf.StaticAuthCode,
+	}
+}
+
+func (cf *Configs) SetAuthProvider(provider string) {
+	cf.mux.Lock()
+	cf.AuthProvider = provider
+	cf.mux.Unlock()
+}
+
+func (cf *Configs) GetMillKey() (accessKey string, secretToken string) {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return cf.MillAccessKey, cf.MillSecretToken
+}
+
+func (cf *Configs) SetMillKey(accessKey string, secretToken string) {
+	cf.mux.Lock()
+	cf.MillAccessKey, cf.MillSecretToken = accessKey, secretToken
+	cf.mux.Unlock()
+	Secrets{MillAccessKey: accessKey, MillSecretToken: secretToken}.register()
+}
+
+func (cf *Configs) GetCredentials() (username string, password string) {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return cf.Username, cf.Password
+}
+
+func (cf *Configs) ClearCredentials() {
+	cf.mux.Lock()
+	cf.Username = ""
+	cf.Password = ""
+	cf.mux.Unlock()
+}
+
+// ClearSecrets forgets all credentials and tokens, the session state shown in the manifest and the uid of the
+// login request. The secret store is wiped on the next SaveToFile, and the values are no longer scrubbed from logs.
+func (cf *Configs) ClearSecrets() {
+	cf.mux.Lock()
+	cf.Auth = AuthTokens{}
+	cf.Accounts = nil
+	cf.HubToken = ""
+	cf.Username = ""
+	cf.Password = ""
+	cf.MillAccessKey = ""
+	cf.MillSecretToken = ""
+	cf.LegacySecrets = nil
+	cf.ConnectionState = ""
+	cf.Errors = ""
+	cf.UID = ""
+	mqttPassword := cf.MqttPassword
+	cf.mux.Unlock()
+	utils.RemoveSecrets("")
+	utils.SetSecret("mqtt_password", mqttPassword)
+}
+
+func (cf *Configs) GetUID() string {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return cf.UID
+}
+
+func (cf *Configs) SetUID(uid string) {
+	cf.mux.Lock()
+	cf.UID = uid
+	cf.mux.Unlock()
+}
+
+// GetInstanceAddress returns the resource address of this adapter instance, "1" unless configured.
+func (cf *Configs) GetInstanceAddress() string {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	if cf.InstanceAddress == "" {
+		return "1"
+	}
+	return cf.InstanceAddress
+}
+
+func (cf *Configs) GetPollTimeMin() string {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return cf.PollTimeMin
+}
+
+func (cf *Configs) SetPollTimeMin(pollTimeMin string) {
+	cf.mux.Lock()
+	cf.PollTimeMin = pollTimeMin
+	cf.mux.Unlock()
+}
+
+func (cf *Configs) GetAutoRelogin() bool {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return cf.AutoRelogin
+}
+
+func (cf *Configs) SetAutoRelogin(autoRelogin bool) {
+	cf.mux.Lock()
+	cf.AutoRelogin = autoRelogin
+	cf.mux.Unlock()
+}
+
+func (cf *Configs) GetKeepFuturehomeNames() bool {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return cf.KeepFuturehomeNames
+}
+
+func (cf *Configs) SetKeepFuturehomeNames(keep bool) {
+	cf.mux.Lock()
+	cf.KeepFuturehomeNames = keep
+	cf.mux.Unlock()
+}
+
+func (cf *Configs) GetSelectedHomes() []string {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return append([]string{}, cf.SelectedHomes...)
+}
+
+func (cf *Configs) SetSelectedHomes(homeIDs []string) {
+	cf.mux.Lock()
+	cf.SelectedHomes = append([]string{}, homeIDs...)
+	cf.mux.Unlock()
+}
+
+// IsHomeSelected is true if devices in the Mill home should be used.
+func (cf *Configs) IsHomeSelected(homeID int64) bool {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	if len(cf.SelectedHomes) == 0 {
+		return true
+	}
+	id := strconv.FormatInt(homeID, 10)
+	for _, selected := range cf.SelectedHomes {
+		if selected == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (cf *Configs) GetLogLevel() string {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return cf.LogLevel
+}
+
+func (cf *Configs) GetLogFile() string {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return cf.LogFile
+}
+
+func (cf *Configs) SetLogLevel(level string) {
+	cf.mux.Lock()
+	cf.LogLevel = level
+	cf.mux.Unlock()
+}
+
+// SetStatus updates connection state and errors shown in the manifest.
+func (cf *Configs) SetStatus(connectionState string, errors string) {
+	cf.mux.Lock()
+	cf.ConnectionState = connectionState
+	cf.Errors = errors
+	cf.mux.Unlock()
+}
+
+func (cf *Configs) GetErrors() string {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
+	return cf.Errors
 }
 
 func (cf *Configs) GetDataDir() string {
@@ -103,7 +527,42 @@ func (cf *Configs) LoadDefaults() error {
 	return utils.CopyFile(defaultConfigFile, configFile)
 }
 
+// ResetToDefaults replaces config.json with the default config and reloads it. The secret store is deleted, the hub
+// secret it is encrypted with is left alone.
+func (cf *Configs) ResetToDefaults() error {
+	cf.saveMux.Lock()
+	defer cf.saveMux.Unlock()
+	cf.mux.RLock()
+	store := cf.secrets
+	cf.mux.RUnlock()
+	if store != nil {
+		if err := store.Wipe(); err != nil {
+			return err
+		}
+	}
+	if err := resetFile(cf.path, filepath.Join(cf.GetDefaultDir(), "config.json")); err != nil {
+		return err
+	}
+	fresh := &Configs{WorkDir: cf.WorkDir, path: cf.path}
+	fresh.mux.Lock()
+	_, err := loadJSONFile(fresh.path, (*configsJSON)(fresh), configMigrations)
+	if err == nil {
+		err = fresh.loadSecrets()
+	}
+	fresh.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	cf.mux.Lock()
+	copyExported(cf, fresh)
+	cf.secrets = fresh.secrets
+	cf.mux.Unlock()
+	return nil
+}
+
 func (cf *Configs) IsConfigured() bool {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
 	if cf.Auth.AccessToken != "" {
 		return true
 	} else {
@@ -112,6 +571,8 @@ func (cf *Configs) IsConfigured() bool {
 }
 
 func (cf *Configs) IsAuthenticated() bool {
+	cf.mux.RLock()
+	defer cf.mux.RUnlock()
 	if cf.Auth.AuthorizationCode != "" {
 		return true
 	} else {
@@ -120,32 +581,42 @@ func (cf *Configs) IsAuthenticated() bool {
 }
 
 type ConfigReport struct {
-	OpStatus string    `json:"op_status"`
-	AppState AppStates `json:"app_state"`
+	OpStatus  string    `json:"op_status"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	ErrorText string    `json:"error_text,omitempty"`
+	AppState  AppStates `json:"app_state"`
 }
 
-func (cf *Configs) GetHubToken(oldMsg *fimpgo.Message) (*fimpgo.Address, *fimpgo.FimpMessage, error) {
-	// mqt := fimpgo.MqttTransport{}
-	err := oldMsg.Payload.GetObjectValue(&cf)
+// SetLogin stores username and password from a cmd.auth.login message. ok is false if either of them is missing.
+func (cf *Configs) SetLogin(oldMsg *fimpgo.Message) (ok bool, err error) {
+	login := Login{}
+	err = oldMsg.Payload.GetObjectValue(&login)
 	if err != nil {
 		log.Error("Could not get object value")
-		return nil, nil, err
+		return false, err
 	}
-	if cf.Username != "" && cf.Password != "" {
-		// Get hub token
-		val := map[string]interface{}{
-			"site_id":     "",
-			"hub_id":      "",
-			"auth_system": "heimdall",
-		}
-		msg := fimpgo.NewMessage("cmd.hub_auth.get_jwt", "auth-api", fimpgo.VTypeStrMap, val, nil, nil, nil)
-		msg.Source = "clbridge"
-		newadr, err := fimpgo.NewAddressFromString("pt:j1/mt:cmd/rt:cloud/rn:auth-api/ad:1")
-		if err != nil {
-			log.Debug("Could not send hub token request")
-			return nil, nil, err
-		}
-		return newadr, msg, nil
+	cf.mux.Lock()
+	cf.Username, cf.Password = login.Username, login.Password
+	cf.mux.Unlock()
+	Secrets{Username: login.Username, Password: login.Password}.register()
+	return login.Username != "" && login.Password != "", nil
+}
+
+// HubTokenRequest builds the request for a hub token. The response from auth-api starts the Mill login. It is
+// sent to the adapter topic of the instance, so only the instance that asked gets it.
+func HubTokenRequest(instanceAddress string) (*fimpgo.Address, *fimpgo.FimpMessage, error) {
+	val := map[string]interface{}{
+		"site_id":     "",
+		"hub_id":      "",
+		"auth_system": "heimdall",
+	}
+	msg := fimpgo.NewMessage("cmd.hub_auth.get_jwt", "auth-api", fimpgo.VTypeStrMap, val, nil, nil, nil)
+	msg.Source = "clbridge"
+	msg.ResponseToTopic = fmt.Sprintf("pt:j1/mt:rsp/rt:ad/rn:%s/ad:%s", ServiceName, instanceAddress)
+	newadr, err := fimpgo.NewAddressFromString("pt:j1/mt:cmd/rt:cloud/rn:auth-api/ad:1")
+	if err != nil {
+		log.Debug("Could not send hub token request")
+		return nil, nil, err
 	}
-	return nil, nil, err
+	return newadr, msg, nil
 }
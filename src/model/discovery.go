@@ -4,13 +4,13 @@ import (
 	"github.com/futurehomeno/fimpgo/discovery"
 )
 
-func GetDiscoveryResource() discovery.Resource {
+func GetDiscoveryResource(instanceAddress string) discovery.Resource {
 	return discovery.Resource{
 		ResourceName:           ServiceName,
 		ResourceType:           discovery.ResourceTypeAd,
 		Author:                 "your email",
 		IsInstanceConfigurable: false,
-		InstanceId:             "1",
+		InstanceId:             instanceAddress,
 		Version:                "1",
 		AdapterInfo: discovery.AdapterInfo{
 			Technology:            "mill",
@@ -30,6 +30,7 @@ const (
 	AuthStateNotAuthenticated = "NOT_AUTHENTICATED"
 	AuthStateAuthenticated    = "AUTHENTICATED"
 	AuthStateInProgress       = "IN_PROGRESS"
+	AuthStateReauthRequired   = "REAUTH_REQUIRED"
 	AuthStateNA               = "NA"
 
 	ConnStateConnecting   = "CONNECTING"
@@ -65,9 +66,11 @@ type SystemEvent struct {
 
 type SystemEventChannel chan SystemEvent
 
+// Lifecycle is safe for concurrent use. stateMux guards the states and is never held while taking busMux.
 type Lifecycle struct {
 	busMux           sync.Mutex
 	systemEventBus   map[string]SystemEventChannel
+	stateMux         sync.RWMutex
 	appState         State
 	previousAppState State
 	lastError        string
@@ -77,6 +80,8 @@ type Lifecycle struct {
 }
 
 func (al *Lifecycle) LastError() string {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
 	return al.lastError
 }
 
@@ -90,6 +95,8 @@ func NewAppLifecycle() *Lifecycle {
 }
 
 func (al *Lifecycle) GetAllStates() *AppStates {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
 	appStates := AppStates{
 		App:           string(al.appState),
 		Connection:    string(al.connectionState),
@@ -102,37 +109,53 @@ func (al *Lifecycle) GetAllStates() *AppStates {
 }
 
 func (al *Lifecycle) ConfigState() State {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
 	return al.configState
 }
 
 func (al *Lifecycle) SetConfigState(configState State) {
+	al.stateMux.Lock()
 	al.configState = configState
+	al.stateMux.Unlock()
 }
 
 func (al *Lifecycle) AuthState() State {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
 	return al.authState
 }
 
 func (al *Lifecycle) SetAuthState(authState State) {
+	al.stateMux.Lock()
 	al.authState = authState
+	al.stateMux.Unlock()
 }
 
 func (al *Lifecycle) ConnectionState() State {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
 	return al.connectionState
 }
 
 func (al *Lifecycle) SetConnectionState(connectivityState State) {
+	al.stateMux.Lock()
 	al.connectionState = connectivityState
+	al.stateMux.Unlock()
 }
 
 func (al *Lifecycle) AppState() State {
+	al.stateMux.RLock()
+	defer al.stateMux.RUnlock()
 	return al.appState
 }
 
 func (al *Lifecycle) SetAppState(currentState State, params map[string]string) {
 	al.busMux.Lock()
+	al.stateMux.Lock()
 	al.previousAppState = al.appState
 	al.appState = currentState
+	al.stateMux.Unlock()
 	log.Debug("<sysEvt> New system state = ", currentState)
 	for i := range al.systemEventBus {
 		select {
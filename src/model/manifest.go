@@ -93,6 +93,8 @@ type ButtonActionResponse struct {
 	Next            string `json:"next"`
 	ErrorCode       string `json:"error_code"`
 	ErrorText       string `json:"error_text"`
+	// Summary holds operation specific results, like SyncSummary for cmd.system.sync.
+	Summary interface{} `json:"summary,omitempty"`
 }
 
 type AppUBLock struct {
@@ -0,0 +1,127 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNewerSchema is returned for files written by a newer version of the app. They are not loaded, since saving
+// them again would downgrade them and drop the fields this version doesn't know.
+var ErrNewerSchema = errors.New("file was written by a newer version of the app")
+
+// schemaVersionKey is the json key holding schema version in config.json and state.json.
+const schemaVersionKey = "schema_version"
+
+// migration upgrades a raw json document from version-1 to version.
+type migration struct {
+	version     int
+	description string
+	migrate     func(doc map[string]interface{}) error
+}
+
+// configMigrations upgrade config.json. Append new migrations at the end, never change released ones.
+var configMigrations = []migration{
+	{
+		version:     1,
+		description: "add schema version",
+		migrate:     func(doc map[string]interface{}) error { return nil },
+	},
+	{
+		version:     2,
+		description: "move credentials and tokens to secret store",
+		migrate: func(doc map[string]interface{}) error {
+			secrets := map[string]interface{}{}
+			moveKey(doc, "username", secrets, "username")
+			moveKey(doc, "password", secrets, "password")
+			moveKey(doc, "token", secrets, "hub_token")
+			if auth, ok := doc["Auth"].(map[string]interface{}); ok {
+				moveKey(auth, "authorization_code", secrets, "authorization_code")
+				moveKey(auth, "access_token", secrets, "access_token")
+				moveKey(auth, "refresh_token", secrets, "refresh_token")
+			}
+			if len(secrets) > 0 {
+				doc["legacy_secrets"] = secrets
+			}
+			return nil
+		},
+	},
+}
+
+// stateMigrations upgrade state.json. Append new migrations at the end, never change released ones.
+var stateMigrations = []migration{
+	{
+		version:     1,
+		description: "fix misspelled keys",
+		migrate: func(doc map[string]interface{}) error {
+			renameKey(doc, "configuret_at", "configured_at")
+			renameKey(doc, "configures_by", "configured_by")
+			renameKey(doc, "IndependentDeviceCollectoin", "IndependentDeviceCollection")
+			return nil
+		},
+	},
+}
+
+// ConfigSchemaVersion is the config.json version written by this build.
+var ConfigSchemaVersion = latestVersion(configMigrations)
+
+// StateSchemaVersion is the state.json version written by this build.
+var StateSchemaVersion = latestVersion(stateMigrations)
+
+func latestVersion(migrations []migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// migrateDocument applies all migrations newer than the version stored in body. migrated is false if the document
+// is already up to date.
+func migrateDocument(name string, body []byte, migrations []migration) (out []byte, migrated bool, err error) {
+	doc := map[string]interface{}{}
+	if err = json.Unmarshal(body, &doc); err != nil {
+		return nil, false, err
+	}
+	version := 0
+	if v, ok := doc[schemaVersionKey].(float64); ok {
+		version = int(v)
+	}
+	latest := latestVersion(migrations)
+	if version > latest {
+		return nil, false, fmt.Errorf("%w: %s has schema version %d, this version supports %d", ErrNewerSchema, name, version, latest)
+	}
+	if version == latest {
+		return body, false, nil
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		log.Infof("<migration> Migrating %s to version %d: %s", name, m.version, m.description)
+		if err = m.migrate(doc); err != nil {
+			return nil, false, fmt.Errorf("migration of %s to version %d failed: %w", name, m.version, err)
+		}
+		doc[schemaVersionKey] = m.version
+	}
+	out, err = json.Marshal(doc)
+	return out, err == nil, err
+}
+
+func renameKey(doc map[string]interface{}, from string, to string) {
+	if val, ok := doc[from]; ok {
+		if _, exists := doc[to]; !exists {
+			doc[to] = val
+		}
+		delete(doc, from)
+	}
+}
+
+// moveKey moves a value from one document to another, possibly under a new key.
+func moveKey(from map[string]interface{}, fromKey string, to map[string]interface{}, toKey string) {
+	if val, ok := from[fromKey]; ok {
+		to[toKey] = val
+		delete(from, fromKey)
+	}
+}
@@ -8,10 +8,12 @@ import (
 	"github.com/futurehomeno/fimpgo/fimptype"
 )
 
+// NetworkService builds inclusion reports for devices of the adapter instance at InstanceAddress.
 type NetworkService struct {
+	InstanceAddress string
 }
 
-func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []interface{}) fimptype.ThingInclusionReport {
+func (ns *NetworkService) SendInclusionReport(device interface{}) fimptype.ThingInclusionReport {
 	var deviceId string
 	// var err error
 
@@ -49,6 +51,11 @@ func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []int
 		MsgType:   "evt.mode.report",
 		ValueType: "string",
 		Version:   "1",
+	}, {
+		Type:      "out",
+		MsgType:   "evt.error.report",
+		ValueType: "string",
+		Version:   "1",
 	}}
 
 	sensorInterfaces := []fimptype.Interface{{
@@ -61,12 +68,56 @@ func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []int
 		MsgType:   "evt.sensor.report",
 		ValueType: "float",
 		Version:   "1",
+	}, {
+		Type:      "out",
+		MsgType:   "evt.error.report",
+		ValueType: "string",
+		Version:   "1",
+	}}
+
+	switchInterfaces := []fimptype.Interface{{
+		Type:      "in",
+		MsgType:   "cmd.binary.set",
+		ValueType: "bool",
+		Version:   "1",
+	}, {
+		Type:      "in",
+		MsgType:   "cmd.binary.get_report",
+		ValueType: "null",
+		Version:   "1",
+	}, {
+		Type:      "out",
+		MsgType:   "evt.binary.report",
+		ValueType: "bool",
+		Version:   "1",
+	}, {
+		Type:      "out",
+		MsgType:   "evt.error.report",
+		ValueType: "string",
+		Version:   "1",
+	}}
+
+	meterInterfaces := []fimptype.Interface{{
+		Type:      "in",
+		MsgType:   "cmd.meter.get_report",
+		ValueType: "string",
+		Version:   "1",
+	}, {
+		Type:      "out",
+		MsgType:   "evt.meter.report",
+		ValueType: "float",
+		Version:   "1",
+	}, {
+		Type:      "out",
+		MsgType:   "evt.error.report",
+		ValueType: "string",
+		Version:   "1",
 	}}
 
 	thermostatService := fimptype.Service{
 		Name:    "thermostat",
 		Alias:   "thermostat",
-		Address: "/rt:dev/rn:mill/ad:1/sv:thermostat/ad:",
+		Address: fmt.Sprintf("/rt:dev/rn:%s/ad:%s/sv:thermostat/ad:", ServiceName, ns.instanceAddress()),
 		Enabled: true,
 		Groups:  []string{"ch_0"},
 		Props: map[string]interface{}{
@@ -79,7 +130,7 @@ func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []int
 	tempSensorService := fimptype.Service{
 		Name:    "sensor_temp",
 		Alias:   "Temperature sensor",
-		Address: "/rt:dev/rn:mill/ad:1/sv:sensor_temp/ad:",
+		Address: fmt.Sprintf("/rt:dev/rn:%s/ad:%s/sv:sensor_temp/ad:", ServiceName, ns.instanceAddress()),
 		Enabled: true,
 		Groups:  []string{"ch_0"},
 		Props: map[string]interface{}{
@@ -90,38 +141,128 @@ func (ns *NetworkService) SendInclusionReport(nodeId int, DeviceCollection []int
 		Interfaces:       sensorInterfaces,
 	}
 
-	device := DeviceCollection[nodeId]
+	humidSensorService := fimptype.Service{
+		Name:    "sensor_humid",
+		Alias:   "Humidity sensor",
+		Address: fmt.Sprintf("/rt:dev/rn:%s/ad:%s/sv:sensor_humid/ad:", ServiceName, ns.instanceAddress()),
+		Enabled: true,
+		Groups:  []string{"ch_0"},
+		Props: map[string]interface{}{
+			"sup_units": []string{"%"},
+		},
+		Interfaces: sensorInterfaces,
+	}
+
+	switchService := fimptype.Service{
+		Name:       "out_bin_switch",
+		Alias:      "Switch",
+		Address:    fmt.Sprintf("/rt:dev/rn:%s/ad:%s/sv:out_bin_switch/ad:", ServiceName, ns.instanceAddress()),
+		Enabled:    true,
+		Groups:     []string{"ch_0"},
+		Props:      map[string]interface{}{},
+		Interfaces: switchInterfaces,
+	}
+
+	meterService := fimptype.Service{
+		Name:    "meter_elec",
+		Alias:   "Electricity meter",
+		Address: fmt.Sprintf("/rt:dev/rn:%s/ad:%s/sv:meter_elec/ad:", ServiceName, ns.instanceAddress()),
+		Enabled: true,
+		Groups:  []string{"ch_0"},
+		Props: map[string]interface{}{
+			"sup_units": []string{"kWh"},
+		},
+		Interfaces: meterInterfaces,
+	}
+
 	val := reflect.ValueOf(device)
-	deviceId = strconv.FormatInt(val.FieldByName("DeviceID").Interface().(int64), 10)
+	product := DeviceProduct(device)
+	deviceId = DeviceAddressOf(device)
 	manufacturer = "mill"
 	name = val.FieldByName("DeviceName").Interface().(string)
 	serviceAddress := fmt.Sprintf("%s", deviceId)
-	thermostatService.Address = thermostatService.Address + serviceAddress
-	tempSensorService.Address = tempSensorService.Address + serviceAddress
-	services = append(services, thermostatService, tempSensorService)
+	if product.Thermostat {
+		thermostatService.Address = thermostatService.Address + serviceAddress
+		thermostatService.Props["sup_temperatures"] = map[string]interface{}{
+			"heat": map[string]float64{"min": product.MinTemp, "max": product.MaxTemp},
+		}
+		services = append(services, thermostatService)
+	}
+	if product.TempSensor {
+		tempSensorService.Address = tempSensorService.Address + serviceAddress
+		services = append(services, tempSensorService)
+	}
+	if product.HumidSensor {
+		humidSensorService.Address = humidSensorService.Address + serviceAddress
+		services = append(services, humidSensorService)
+	}
+	if product.Switch {
+		switchService.Address = switchService.Address + serviceAddress
+		services = append(services, switchService)
+	}
+	if product.Meter {
+		meterService.Address = meterService.Address + serviceAddress
+		services = append(services, meterService)
+	}
 	deviceAddr = fmt.Sprintf("%s", deviceId)
 	powerSource := "ac"
 
+	techProps := map[string]string{
+		"device_type":   strconv.Itoa(product.DeviceType),
+		"sub_domain_id": strconv.Itoa(intField(val, "SubDomainID")),
+	}
+	if mac := val.FieldByName("Mac"); mac.IsValid() && mac.String() != "" {
+		techProps["mac"] = mac.String()
+	}
+	for key, value := range DeviceLocation(device) {
+		techProps[key] = value
+	}
+
 	inclReport := fimptype.ThingInclusionReport{
 		IntegrationId:     "",
 		Address:           deviceAddr,
 		Type:              "",
-		ProductHash:       manufacturer,
+		ProductHash:       product.Hash,
 		CommTechnology:    "wifi",
-		ProductName:       name,
+		Alias:             name,
+		ProductName:       product.Name,
+		ProductId:         product.Hash,
 		ManufacturerId:    manufacturer,
 		DeviceId:          deviceId,
-		HwVersion:         "1",
-		SwVersion:         "1",
+		HwVersion:         product.Generation,
+		SwVersion:         "",
 		PowerSource:       powerSource,
 		WakeUpInterval:    "-1",
 		Security:          "",
 		Tags:              nil,
 		Groups:            []string{"ch_0"},
 		PropSets:          nil,
-		TechSpecificProps: nil,
+		TechSpecificProps: techProps,
 		Services:          services,
 	}
 
 	return inclReport
 }
+
+// DeviceLocation returns the Mill home and room of a device, and whether it is independent, i.e. not in a room.
+func DeviceLocation(device interface{}) map[string]string {
+	val := reflect.ValueOf(device)
+	location := map[string]string{}
+	if home := val.FieldByName("HomeName"); home.IsValid() && home.String() != "" {
+		location["home"] = home.String()
+	}
+	if room := val.FieldByName("RoomName"); room.IsValid() && room.String() != "" {
+		location["room"] = room.String()
+	}
+	if independent := val.FieldByName("Independent"); independent.IsValid() {
+		location["independent"] = strconv.FormatBool(independent.Bool())
+	}
+	return location
+}
+
+func (ns *NetworkService) instanceAddress() string {
+	if ns.InstanceAddress == "" {
+		return "1"
+	}
+	return ns.InstanceAddress
+}
@@ -0,0 +1,106 @@
+package model
+
+import "reflect"
+
+// Mill device types, as reported in Device.DeviceType.
+const (
+	MillDeviceTypePanelHeater = 0
+	MillDeviceTypeOilHeater   = 1
+	MillDeviceTypeConvector   = 2
+	MillDeviceTypeSocket      = 3
+	MillDeviceTypeSense       = 4
+)
+
+// Product describes a Mill product model, and which services the adapter exposes for it.
+type Product struct {
+	Name       string
+	Hash       string
+	Generation string
+	DeviceType int
+	// SubDomainIDs are the Mill sub domain ids identifying this model. Products without any are used as fallback
+	// for their device type.
+	SubDomainIDs []int
+	MinTemp      float64
+	MaxTemp      float64
+	Thermostat   bool
+	TempSensor   bool
+	HumidSensor  bool
+	Switch       bool
+	Meter        bool
+}
+
+// productCatalogue lists known Mill products. Sub domain ids not found here fall back to the generic product of
+// the device type, and unknown device types to a generic panel heater.
+//
+// Device types and sub domain ids are the deviceType and subDomainId fields of the device lists returned by the
+// Mill open API (https://api.millheat.com, selectDevicebyRoom and getIndependentDevices). The API documentation
+// describes the fields but doesn't list the values per model, so the ids below are the ones reported by each model
+// and have to be added here when Mill releases new ones:
+//   - 863: panel heater Gen1
+//   - 5316, 5317, 5332: panel heater Gen2
+//   - 6933: panel heater Gen3
+//   - 5333: oil heater Gen2
+//   - 6932: oil heater Gen3
+//   - 6931: convector heater Gen3
+//   - 6934: WiFi socket Gen3
+var productCatalogue = []Product{
+	{Name: "Mill panel heater Gen1", Hash: "mill_panel_heater_gen1", Generation: "1", DeviceType: MillDeviceTypePanelHeater, SubDomainIDs: []int{863}, MinTemp: 5, MaxTemp: 35, Thermostat: true, TempSensor: true},
+	{Name: "Mill panel heater Gen2", Hash: "mill_panel_heater_gen2", Generation: "2", DeviceType: MillDeviceTypePanelHeater, SubDomainIDs: []int{5316, 5317, 5332}, MinTemp: 5, MaxTemp: 35, Thermostat: true, TempSensor: true},
+	{Name: "Mill panel heater Gen3", Hash: "mill_panel_heater_gen3", Generation: "3", DeviceType: MillDeviceTypePanelHeater, SubDomainIDs: []int{6933}, MinTemp: 5, MaxTemp: 35, Thermostat: true, TempSensor: true},
+	{Name: "Mill panel heater", Hash: "mill_panel_heater", DeviceType: MillDeviceTypePanelHeater, MinTemp: 5, MaxTemp: 35, Thermostat: true, TempSensor: true},
+	{Name: "Mill oil heater Gen2", Hash: "mill_oil_heater_gen2", Generation: "2", DeviceType: MillDeviceTypeOilHeater, SubDomainIDs: []int{5333}, MinTemp: 5, MaxTemp: 35, Thermostat: true, TempSensor: true},
+	{Name: "Mill oil heater Gen3", Hash: "mill_oil_heater_gen3", Generation: "3", DeviceType: MillDeviceTypeOilHeater, SubDomainIDs: []int{6932}, MinTemp: 5, MaxTemp: 35, Thermostat: true, TempSensor: true},
+	{Name: "Mill oil heater", Hash: "mill_oil_heater", DeviceType: MillDeviceTypeOilHeater, MinTemp: 5, MaxTemp: 35, Thermostat: true, TempSensor: true},
+	{Name: "Mill convector heater Gen3", Hash: "mill_convector_gen3", Generation: "3", DeviceType: MillDeviceTypeConvector, SubDomainIDs: []int{6931}, MinTemp: 5, MaxTemp: 35, Thermostat: true, TempSensor: true},
+	{Name: "Mill convector heater", Hash: "mill_convector", DeviceType: MillDeviceTypeConvector, MinTemp: 5, MaxTemp: 35, Thermostat: true, TempSensor: true},
+	{Name: "Mill WiFi socket Gen3", Hash: "mill_socket_gen3", Generation: "3", DeviceType: MillDeviceTypeSocket, SubDomainIDs: []int{6934}, Switch: true, Meter: true},
+	{Name: "Mill WiFi socket", Hash: "mill_socket", DeviceType: MillDeviceTypeSocket, Switch: true, Meter: true},
+	{Name: "Mill Sense", Hash: "mill_sense", Generation: "1", DeviceType: MillDeviceTypeSense, TempSensor: true, HumidSensor: true},
+}
+
+// LookupProduct finds the product for a Mill device type and sub domain id.
+func LookupProduct(deviceType, subDomainID int) Product {
+	var fallback *Product
+	for i := range productCatalogue {
+		product := &productCatalogue[i]
+		for _, id := range product.SubDomainIDs {
+			if id == subDomainID {
+				return *product
+			}
+		}
+		if fallback == nil && product.DeviceType == deviceType && len(product.SubDomainIDs) == 0 {
+			fallback = product
+		}
+	}
+	if fallback != nil {
+		return *fallback
+	}
+	return LookupProduct(MillDeviceTypePanelHeater, 0)
+}
+
+// DeviceProduct finds the product of a device from the device list. Not all sockets have a temperature sensor, so
+// they only get one if they report an ambient temperature.
+func DeviceProduct(device interface{}) Product {
+	val := reflect.ValueOf(device)
+	product := LookupProduct(intField(val, "DeviceType"), intField(val, "SubDomainID"))
+	if product.DeviceType == MillDeviceTypeSocket && floatField(val, "AmbientTemp") != 0 {
+		product.TempSensor = true
+	}
+	return product
+}
+
+func intField(val reflect.Value, name string) int {
+	field := val.FieldByName(name)
+	if !field.IsValid() {
+		return 0
+	}
+	return int(field.Int())
+}
+
+func floatField(val reflect.Value, name string) float64 {
+	field := val.FieldByName(name)
+	if !field.IsValid() {
+		return 0
+	}
+	return field.Float()
+}
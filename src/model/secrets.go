@@ -0,0 +1,199 @@
+package model
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+
+	"github.com/futurehomeno/edge-mill-adapter/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// secretKeyContext separates the key used for the secret store from other keys derived from the same hub secret.
+const secretKeyContext = "edge-mill-adapter/secrets/v1"
+
+// Secrets holds credentials and tokens. They are never written to config.json.
+type Secrets struct {
+	AuthorizationCode string `json:"authorization_code"`
+	AccessToken       string `json:"access_token"`
+	RefreshToken      string `json:"refresh_token"`
+	HubToken          string `json:"hub_token"`
+	Username          string `json:"username"`
+	Password          string `json:"password"`
+	MillAccessKey     string `json:"mill_access_key"`
+	MillSecretToken   string `json:"mill_secret_token"`
+	// Accounts are the secrets of extra accounts, by account id.
+	Accounts map[string]AccountSecrets `json:"accounts,omitempty"`
+}
+
+// register makes the log formatter scrub the secret values. Empty values are skipped, so a partly filled Secrets
+// only replaces the values it holds.
+func (s Secrets) register() {
+	registerSecrets("", map[string]string{
+		"authorization_code": s.AuthorizationCode,
+		"access_token":       s.AccessToken,
+		"refresh_token":      s.RefreshToken,
+		"hub_token":          s.HubToken,
+		"username":           s.Username,
+		"password":           s.Password,
+		"mill_access_key":    s.MillAccessKey,
+		"mill_secret_token":  s.MillSecretToken,
+	})
+	for id, account := range s.Accounts {
+		account.register(id)
+	}
+}
+
+func registerSecrets(prefix string, values map[string]string) {
+	for name, val := range values {
+		if val != "" {
+			utils.SetSecret(prefix+name, val)
+		}
+	}
+}
+
+// isEmpty is true if there is nothing to keep in the secret store.
+func (s Secrets) isEmpty() bool {
+	if len(s.Accounts) > 0 {
+		return false
+	}
+	s.Accounts = nil
+	return reflect.DeepEqual(s, Secrets{})
+}
+
+// SecretStore keeps Secrets encrypted at rest with AES-GCM. The key is derived from a random hub secret, generated
+// on first save and only readable by the adapter.
+type SecretStore struct {
+	path    string
+	keyFile string
+}
+
+func NewSecretStore(path string, keyFile string) *SecretStore {
+	return &SecretStore{path: path, keyFile: keyFile}
+}
+
+// Load decrypts the store. Empty secrets are returned if nothing has been stored yet.
+func (ss *SecretStore) Load() (Secrets, error) {
+	secrets := Secrets{}
+	if !utils.FileExists(ss.path) && !utils.FileExists(utils.BackupPath(ss.path)) {
+		return secrets, nil
+	}
+	gcm, err := ss.cipher(false)
+	if err != nil {
+		return secrets, err
+	}
+	return ss.decrypt(gcm)
+}
+
+// decrypt reads the store, or its backup generation if the store can't be decrypted.
+func (ss *SecretStore) decrypt(gcm cipher.AEAD) (Secrets, error) {
+	secrets := Secrets{}
+	decrypt := func(path string) error {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if len(body) < gcm.NonceSize() {
+			return errors.New("secret store is truncated")
+		}
+		plain, err := gcm.Open(nil, body[:gcm.NonceSize()], body[gcm.NonceSize():], nil)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(plain, &secrets)
+	}
+	err := decrypt(ss.path)
+	if err != nil {
+		log.Warn("<secrets> Can't decrypt secret store, trying backup. Error: ", err)
+		secrets = Secrets{}
+		if bErr := decrypt(utils.BackupPath(ss.path)); bErr != nil {
+			return Secrets{}, err
+		}
+	}
+	return secrets, nil
+}
+
+// Save encrypts secrets and writes them to the store.
+func (ss *SecretStore) Save(secrets Secrets) error {
+	gcm, err := ss.cipher(true)
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(ss.path, gcm.Seal(nonce, nonce, plain, nil), 0600)
+}
+
+// Wipe deletes the store together with its backup generation. The hub secret is left alone.
+func (ss *SecretStore) Wipe() error {
+	os.Remove(utils.BackupPath(ss.path))
+	if err := os.Remove(ss.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// cipher derives the store key from the hub secret. The hub secret is generated if create is true and there is none.
+func (ss *SecretStore) cipher(create bool) (cipher.AEAD, error) {
+	hubSecret, err := ss.hubSecret(create)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, hubSecret)
+	mac.Write([]byte(secretKeyContext))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (ss *SecretStore) hubSecret(create bool) ([]byte, error) {
+	info, err := os.Stat(ss.keyFile)
+	if os.IsNotExist(err) {
+		if !create {
+			return nil, fmt.Errorf("hub secret file %s is missing", ss.keyFile)
+		}
+		log.Info("<secrets> Generating new hub secret file ", ss.keyFile)
+		secret := make([]byte, 32)
+		if _, err = io.ReadFull(rand.Reader, secret); err != nil {
+			return nil, err
+		}
+		if err = utils.WriteFileAtomic(ss.keyFile, secret, 0600); err != nil {
+			return nil, err
+		}
+		return secret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Warn("<secrets> Hub secret file is readable by others, restricting it to the adapter")
+		if err = os.Chmod(ss.keyFile, 0600); err != nil {
+			return nil, err
+		}
+	}
+	secret, err := ioutil.ReadFile(ss.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("hub secret file is empty")
+	}
+	return secret, nil
+}
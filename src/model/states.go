@@ -3,39 +3,67 @@ package model
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
-	"strconv"
+	"sync"
 	"time"
 
+	mill "github.com/futurehomeno/edge-mill-adapter/millapi"
 	"github.com/futurehomeno/edge-mill-adapter/utils"
 	log "github.com/sirupsen/logrus"
 )
 
+// States is safe for concurrent use when accessed through its methods.
 type States struct {
-	path         string
-	LogFile      string `json:"log_file"`
-	LogLevel     string `json:"log_level"`
-	LogFormat    string `json:"log_format"`
-	WorkDir      string `json:"-"`
-	ConfiguredAt string `json:"configuret_at"`
-	ConfiguredBy string `json:"configures_by"`
+	path          string
+	mux           sync.RWMutex
+	saveMux       sync.Mutex
+	SchemaVersion int    `json:"schema_version"`
+	LogFile       string `json:"log_file"`
+	LogLevel      string `json:"log_level"`
+	LogFormat     string `json:"log_format"`
+	WorkDir       string `json:"-"`
+	ConfiguredAt  string `json:"configured_at"`
+	ConfiguredBy  string `json:"configured_by"`
 
 	HomeCollection              []interface{}
 	RoomCollection              []interface{}
 	DeviceCollection            []interface{}
 	IndependentDeviceCollection []interface{}
+
+	// KnownDevices are the devices included in Futurehome, by address. Sync compares them with the devices from Mill.
+	KnownDevices map[string]KnownDevice `json:"known_devices"`
+	// IgnoredDevices are devices deleted by the user, by address. They are skipped by sync and polling until restored.
+	IgnoredDevices map[string]string `json:"ignored_devices"`
+	// Setpoints are the last setpoints delivered to Mill, by address. Mill doesn't report them in the device list.
+	Setpoints map[string]string `json:"setpoints,omitempty"`
+	// MeterTotals are the running energy totals of sockets, by address. Mill only reports the energy used this month.
+	MeterTotals map[string]MeterTotal `json:"meter_totals,omitempty"`
+}
+
+// MeterTotal is the energy used by a socket, split into earlier months and the last value reported for this month.
+type MeterTotal struct {
+	PreviousMonthsKwh float64 `json:"previous_months_kwh"`
+	MonthKwh          float64 `json:"month_kwh"`
 }
 
+// KnownDevice is an included device. Fingerprint changes when the inclusion report of the device changes.
+type KnownDevice struct {
+	Name        string `json:"name"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// statesJSON has the fields of States without its methods, so it can be marshalled while the lock is held.
+type statesJSON States
+
 func NewStates(workDir string) *States {
 	state := &States{WorkDir: workDir}
 	state.path = filepath.Join(workDir, "data", "state.json")
 	if !utils.FileExists(state.path) {
 		log.Info("State file doesn't exist.Loading default state")
 		defaultStateFile := filepath.Join(workDir, "defaults", "state.json")
-		err := utils.CopyFile(defaultStateFile, state.path)
+		err := restoreFile(state.path, defaultStateFile)
 		if err != nil {
 			fmt.Print(err)
 			panic("Can't copy state file.")
@@ -44,27 +72,250 @@ func NewStates(workDir string) *States {
 	return state
 }
 
+// LoadFromFile loads states, upgrading the file to the current schema version if it was written by an older version.
 func (st *States) LoadFromFile() error {
-	stateFileBody, err := ioutil.ReadFile(st.path)
-	if err != nil {
+	st.mux.Lock()
+	migrated, err := loadJSONFile(st.path, (*statesJSON)(st), stateMigrations)
+	if err == nil {
+		err = st.decodeCollections()
+	}
+	st.mux.Unlock()
+	if err != nil || !migrated {
 		return err
 	}
-	err = json.Unmarshal(stateFileBody, st)
-	if err != nil {
+	return st.SaveToFile()
+}
+
+// decodeCollections turns homes, rooms and devices read from the state file into the types of the Mill client. JSON
+// decodes them as maps, which the helpers reading device fields can't handle.
+func (st *States) decodeCollections() error {
+	var err error
+	if st.HomeCollection, err = decodeList(st.HomeCollection, mill.Home{}); err != nil {
 		return err
 	}
-	return nil
+	if st.RoomCollection, err = decodeList(st.RoomCollection, mill.Room{}); err != nil {
+		return err
+	}
+	if st.DeviceCollection, err = decodeList(st.DeviceCollection, mill.Device{}); err != nil {
+		return err
+	}
+	st.IndependentDeviceCollection, err = decodeList(st.IndependentDeviceCollection, mill.Device{})
+	return err
+}
+
+// decodeList decodes the maps in list into values of the same type as item.
+func decodeList(list []interface{}, item interface{}) ([]interface{}, error) {
+	if list == nil {
+		return nil, nil
+	}
+	decoded := make([]interface{}, len(list))
+	for i, elem := range list {
+		if _, isMap := elem.(map[string]interface{}); !isMap {
+			decoded[i] = elem
+			continue
+		}
+		bytes, err := json.Marshal(elem)
+		if err != nil {
+			return nil, err
+		}
+		val := reflect.New(reflect.TypeOf(item))
+		if err = json.Unmarshal(bytes, val.Interface()); err != nil {
+			return nil, fmt.Errorf("can't decode %T from state file: %w", item, err)
+		}
+		decoded[i] = val.Elem().Interface()
+	}
+	return decoded, nil
 }
 
 func (st *States) SaveToFile() error {
+	st.saveMux.Lock()
+	defer st.saveMux.Unlock()
+	st.mux.Lock()
 	st.ConfiguredBy = "auto"
 	st.ConfiguredAt = time.Now().Format(time.RFC3339)
-	bpayload, err := json.Marshal(st)
-	err = ioutil.WriteFile(st.path, bpayload, 0664)
+	st.SchemaVersion = StateSchemaVersion
+	bpayload, err := json.Marshal((*statesJSON)(st))
+	st.mux.Unlock()
 	if err != nil {
 		return err
 	}
-	return err
+	return utils.WriteFileAtomic(st.path, bpayload, 0664)
+}
+
+// MarshalJSON takes a read lock, so states can be sent in reports while other goroutines update them.
+func (st *States) MarshalJSON() ([]byte, error) {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	return json.Marshal((*statesJSON)(st))
+}
+
+// SetCollections replaces home, room and device lists with freshly fetched ones.
+func (st *States) SetCollections(homes []interface{}, rooms []interface{}, devices []interface{}, independentDevices []interface{}) {
+	st.mux.Lock()
+	st.HomeCollection = homes
+	st.RoomCollection = rooms
+	st.DeviceCollection = devices
+	st.IndependentDeviceCollection = independentDevices
+	st.mux.Unlock()
+}
+
+// ClearCollections removes all homes, rooms and devices, the setpoints sent to them and their meter totals.
+func (st *States) ClearCollections() {
+	st.SetCollections(nil, nil, nil, nil)
+	st.mux.Lock()
+	st.Setpoints = nil
+	st.MeterTotals = nil
+	st.mux.Unlock()
+}
+
+// AddMeterReading records the energy Mill reports a socket has used this month, and returns the running total. A
+// value lower than the last one means a new month has started, so the last value is moved to the earlier months.
+func (st *States) AddMeterReading(addr string, monthKwh float64) float64 {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	if st.MeterTotals == nil {
+		st.MeterTotals = make(map[string]MeterTotal)
+	}
+	total := st.MeterTotals[addr]
+	if monthKwh < total.MonthKwh {
+		total.PreviousMonthsKwh += total.MonthKwh
+	}
+	total.MonthKwh = monthKwh
+	st.MeterTotals[addr] = total
+	return total.PreviousMonthsKwh + total.MonthKwh
+}
+
+// GetSetpoint returns the last setpoint delivered to a device, or "" if none is known.
+func (st *States) GetSetpoint(addr string) string {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	return st.Setpoints[addr]
+}
+
+func (st *States) SetSetpoint(addr string, temp string) {
+	st.mux.Lock()
+	if st.Setpoints == nil {
+		st.Setpoints = make(map[string]string)
+	}
+	st.Setpoints[addr] = temp
+	st.mux.Unlock()
+}
+
+// GetKnownDevices returns a copy of the known devices.
+func (st *States) GetKnownDevices() map[string]KnownDevice {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	known := make(map[string]KnownDevice, len(st.KnownDevices))
+	for addr, device := range st.KnownDevices {
+		known[addr] = device
+	}
+	return known
+}
+
+func (st *States) SetKnownDevice(addr string, device KnownDevice) {
+	st.mux.Lock()
+	if st.KnownDevices == nil {
+		st.KnownDevices = make(map[string]KnownDevice)
+	}
+	st.KnownDevices[addr] = device
+	st.mux.Unlock()
+}
+
+// ForgetKnownDevice removes a device from the known devices, so the next sync includes it again.
+func (st *States) ForgetKnownDevice(addr string) {
+	st.mux.Lock()
+	delete(st.KnownDevices, addr)
+	st.mux.Unlock()
+}
+
+// IgnoreDevice adds a device to the ignored devices. name is shown when restoring it.
+func (st *States) IgnoreDevice(addr string, name string) {
+	st.mux.Lock()
+	if st.IgnoredDevices == nil {
+		st.IgnoredDevices = make(map[string]string)
+	}
+	st.IgnoredDevices[addr] = name
+	st.mux.Unlock()
+}
+
+// RestoreDevice removes a device from the ignored devices. It returns false if the device wasn't ignored.
+func (st *States) RestoreDevice(addr string) bool {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	if _, ok := st.IgnoredDevices[addr]; !ok {
+		return false
+	}
+	delete(st.IgnoredDevices, addr)
+	return true
+}
+
+func (st *States) IsIgnored(addr string) bool {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	_, ok := st.IgnoredDevices[addr]
+	return ok
+}
+
+func (st *States) ClearIgnoredDevices() {
+	st.mux.Lock()
+	st.IgnoredDevices = nil
+	st.mux.Unlock()
+}
+
+// GetIgnoredDevices returns a copy of the ignored devices, address to name.
+func (st *States) GetIgnoredDevices() map[string]string {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	ignored := make(map[string]string, len(st.IgnoredDevices))
+	for addr, name := range st.IgnoredDevices {
+		ignored[addr] = name
+	}
+	return ignored
+}
+
+func (st *States) ClearKnownDevices() {
+	st.mux.Lock()
+	st.KnownDevices = nil
+	st.mux.Unlock()
+}
+
+// Devices returns a copy of the device list.
+func (st *States) Devices() []interface{} {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	devices := make([]interface{}, len(st.DeviceCollection))
+	copy(devices, st.DeviceCollection)
+	return devices
+}
+
+// IndependentDevices returns a copy of the list of devices that aren't in a room.
+func (st *States) IndependentDevices() []interface{} {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	devices := make([]interface{}, len(st.IndependentDeviceCollection))
+	copy(devices, st.IndependentDeviceCollection)
+	return devices
+}
+
+// Homes returns a copy of the list of all homes on the Mill account, including homes that aren't selected.
+func (st *States) Homes() []interface{} {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	homes := make([]interface{}, len(st.HomeCollection))
+	copy(homes, st.HomeCollection)
+	return homes
+}
+
+// DeviceByID returns the device with the given device address.
+func (st *States) DeviceByID(addr string) (interface{}, bool) {
+	st.mux.RLock()
+	defer st.mux.RUnlock()
+	for _, device := range st.DeviceCollection {
+		if DeviceAddressOf(device) == addr {
+			return device, true
+		}
+	}
+	return nil, false
 }
 
 func (st *States) GetDataDir() string {
@@ -83,6 +334,26 @@ func (st *States) LoadDefaults() error {
 	return utils.CopyFile(defaultStateFile, stateFile)
 }
 
+// ResetToDefaults replaces state.json with the default state and reloads it.
+func (st *States) ResetToDefaults() error {
+	st.saveMux.Lock()
+	defer st.saveMux.Unlock()
+	if err := resetFile(st.path, filepath.Join(st.GetDefaultDir(), "state.json")); err != nil {
+		return err
+	}
+	fresh := &States{WorkDir: st.WorkDir, path: st.path}
+	if _, err := loadJSONFile(fresh.path, (*statesJSON)(fresh), stateMigrations); err != nil {
+		return err
+	}
+	if err := fresh.decodeCollections(); err != nil {
+		return err
+	}
+	st.mux.Lock()
+	copyExported(st, fresh)
+	st.mux.Unlock()
+	return nil
+}
+
 func (st *States) IsConfigured() bool {
 	// TODO : Add logic here
 	// I need to save AccessToken, RefreshToken, ExpireTime, RefreshExpireTime, HomeCollection, RoomCollection, DeviceCollection, IndependentDeviceCollection
@@ -97,26 +368,23 @@ type StateReport struct {
 	AppState AppStates `json:"app_state"`
 }
 
+// FindDeviceFromDeviceID returns the index of a device in its collection, or ErrDeviceNotFound.
 func (st *States) FindDeviceFromDeviceID(addr string) (index int, err error) {
 	// cf.LoadFromFile()
+	st.mux.RLock()
+	defer st.mux.RUnlock()
 
 	for i := 0; i < len(st.DeviceCollection); i++ {
-		val := reflect.ValueOf(st.DeviceCollection[i])
-		deviceId := strconv.FormatInt(val.FieldByName("DeviceID").Interface().(int64), 10)
-		if deviceId == addr {
+		if DeviceAddressOf(st.DeviceCollection[i]) == addr {
 			index = i
 			return index, nil
 		}
 	}
 	for i := 0; i < len(st.IndependentDeviceCollection); i++ {
-		val := reflect.ValueOf(st.IndependentDeviceCollection[i])
-		deviceId := strconv.FormatInt(val.FieldByName("DeviceID").Interface().(int64), 10)
-		if deviceId == addr {
+		if DeviceAddressOf(st.IndependentDeviceCollection[i]) == addr {
 			index = i
 			return index, nil
 		}
 	}
-	index = 9999 // using err did not work
-	log.Debug(err)
-	return index, err
+	return -1, ErrDeviceNotFound
 }
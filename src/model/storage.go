@@ -0,0 +1,84 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/futurehomeno/edge-mill-adapter/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// loadJSONFile unmarshals the file at path into holder, upgrading it with migrations first. If the file is missing
+// or corrupt, for instance after a power cut during write, the backup generation is used instead.
+// migrated is true if the loaded document was upgraded and should be saved.
+func loadJSONFile(path string, holder interface{}, migrations []migration) (migrated bool, err error) {
+	decode := func(body []byte) (bool, error) {
+		migrated := false
+		if migrations != nil {
+			var err error
+			if body, migrated, err = migrateDocument(filepath.Base(path), body, migrations); err != nil {
+				return false, err
+			}
+		}
+		return migrated, json.Unmarshal(body, holder)
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if err == nil {
+		if migrated, err = decode(body); err == nil {
+			return migrated, nil
+		}
+		if errors.Is(err, ErrNewerSchema) {
+			// The backup may be older, loading it would overwrite the newer file on next save.
+			return false, err
+		}
+	}
+	backupPath := utils.BackupPath(path)
+	if !utils.FileExists(backupPath) {
+		return false, err
+	}
+	log.Warnf("<storage> Can't load %s, loading backup. Error: %v", path, err)
+	body, bErr := ioutil.ReadFile(backupPath)
+	if bErr != nil {
+		return false, err
+	}
+	if migrated, bErr = decode(body); bErr != nil {
+		return false, err
+	}
+	return migrated, nil
+}
+
+// restoreFile makes sure there is a file at path, taking the backup generation if there is one and defaultPath otherwise.
+func restoreFile(path string, defaultPath string) error {
+	if utils.FileExists(path) {
+		return nil
+	}
+	if backupPath := utils.BackupPath(path); utils.FileExists(backupPath) {
+		log.Warnf("<storage> %s is missing, restoring backup", path)
+		return utils.CopyFile(backupPath, path)
+	}
+	return utils.CopyFile(defaultPath, path)
+}
+
+// resetFile replaces the file at path and its backup generation with the file at defaultPath.
+func resetFile(path string, defaultPath string) error {
+	os.Remove(utils.BackupPath(path))
+	os.Remove(path)
+	return utils.CopyFile(defaultPath, path)
+}
+
+// copyExported copies all exported fields of src to dst. Both must be pointers to the same struct type. Locks and
+// other unexported fields of dst are left as they are.
+func copyExported(dst interface{}, src interface{}) {
+	dstVal := reflect.ValueOf(dst).Elem()
+	srcVal := reflect.ValueOf(src).Elem()
+	for i := 0; i < dstVal.NumField(); i++ {
+		if dstVal.Type().Field(i).PkgPath == "" {
+			dstVal.Field(i).Set(srcVal.Field(i))
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	mill "github.com/futurehomeno/edge-mill-adapter/millapi"
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// AccountReport is an entry in evt.auth.accounts_report. Credentials and tokens are never reported.
+type AccountReport struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	AuthState string `json:"auth_state"`
+}
+
+// addAccount adds an extra Mill user and logs in with it. The primary account must be logged in first.
+func (fc *FromFimpRouter) addAccount(reqPayload *fimpgo.FimpMessage) error {
+	val, err := reqPayload.GetStrMapValue()
+	if err != nil {
+		return invalidPayload(err)
+	}
+	if !fc.configs.IsConfigured() {
+		return fmt.Errorf("%w, log in with the primary account before adding accounts", errNotAuthenticated)
+	}
+	if val["name"] == "" || val["username"] == "" || val["password"] == "" {
+		return invalidPayload(errors.New("name, username and password are required"))
+	}
+	account := fc.configs.AddAccount(val["name"], val["username"], val["password"])
+	log.Infof("<router> Added account %s with id %s", account.Name, account.ID)
+	fc.configs.SaveToFile()
+	return fc.requestAuthCode(account.ID, reqPayload)
+}
+
+// removeAccount excludes the devices of an extra account and forgets it.
+func (fc *FromFimpRouter) removeAccount(accountID string, reqPayload *fimpgo.FimpMessage) error {
+	account, ok := fc.configs.GetAccount(accountID)
+	if !ok {
+		return invalidPayload(errors.New("unknown account " + accountID))
+	}
+	for addr := range fc.states.GetKnownDevices() {
+		if owner, err := model.ParseDeviceAddress(addr); err == nil && owner.AccountID == accountID {
+			fc.publishExclusionReport(addr, reqPayload)
+			fc.states.ForgetKnownDevice(addr)
+		}
+	}
+	for addr := range fc.states.GetIgnoredDevices() {
+		if owner, err := model.ParseDeviceAddress(addr); err == nil && owner.AccountID == accountID {
+			fc.states.RestoreDevice(addr)
+		}
+	}
+	fc.reloginMux.Lock()
+	delete(fc.accountRelogin, accountID)
+	fc.reloginMux.Unlock()
+	fc.configs.RemoveAccount(accountID)
+	if err := fc.configs.SaveToFile(); err != nil {
+		return err
+	}
+	log.Infof("<router> Removed account %s", account.Name)
+	if err := fc.UpdateLists(); err != nil {
+		log.Error("<router> Can't update lists after removing account. Error: ", err)
+	}
+	return fc.states.SaveToFile()
+}
+
+// accountLogin exchanges the authorization code of an extra account for tokens, and includes its devices.
+func (fc *FromFimpRouter) accountLogin(accountID string, reqPayload *fimpgo.FimpMessage) {
+	account, ok := fc.configs.GetAccount(accountID)
+	if !ok {
+		log.Error("<router> Login finished for unknown account ", accountID)
+		return
+	}
+	var err error
+	if account.Auth.AuthorizationCode == "" {
+		err = mill.ErrAuthCodeMissing
+	} else {
+		config := mill.Config{}
+		account.Auth.AccessToken, account.Auth.RefreshToken, account.Auth.ExpireTime, account.Auth.RefreshExpireTime, err = config.NewClient(account.Auth.AuthorizationCode, account.Password, account.Username)
+	}
+	fc.finishAccountLogin(account, err, reqPayload)
+}
+
+// finishAccountLogin saves and reports the result of a login with an extra account, and includes its devices if it
+// succeeded.
+func (fc *FromFimpRouter) finishAccountLogin(account model.Account, err error, reqPayload *fimpgo.FimpMessage) {
+	accountID := account.ID
+	fc.reloginMux.Lock()
+	_, relogin := fc.accountRelogin[accountID]
+	fc.reloginMux.Unlock()
+
+	status := loginStatus(err)
+	status.Account = accountID
+	if err == nil {
+		log.Infof("<router> Logged in to Mill with account %s", account.Name)
+		account.AuthState = string(model.AuthStateAuthenticated)
+		fc.reloginMux.Lock()
+		delete(fc.accountRelogin, accountID)
+		fc.reloginMux.Unlock()
+	} else if relogin {
+		log.Errorf("<router> Automatic re-login of account %s failed. Error: %v", account.Name, err)
+		account.AuthState = string(model.AuthStateReauthRequired)
+	} else {
+		log.Errorf("<router> Login with account %s failed. Error code: %s, error: %v", account.Name, status.ErrorCode, err)
+		account.AuthState = string(model.AuthStateNotAuthenticated)
+	}
+	if !fc.configs.GetAutoRelogin() {
+		account.Username, account.Password = "", ""
+	}
+	fc.configs.UpdateAccount(account)
+	fc.configs.SaveToFile()
+
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID}
+	if !relogin || err != nil {
+		msg := fimpgo.NewMessage("evt.auth.status_report", model.ServiceName, fimpgo.VTypeObject, status, nil, nil, reqPayload)
+		fc.mqt.Publish(adr, msg)
+	}
+	fc.publishAccountsReport(reqPayload)
+	if err != nil || relogin {
+		return
+	}
+	if _, err = fc.syncDevices(reqPayload); err != nil {
+		log.Error("<router> Can't sync devices after login. Error: ", err)
+	}
+}
+
+// refreshAccounts gets new tokens for extra accounts whose access token has expired. Accounts whose refresh token
+// has expired are logged in again if auto re-login is enabled, otherwise the user has to add them again.
+// Must be called with refreshMux held.
+func (fc *FromFimpRouter) refreshAccounts() {
+	millis := time.Now().UnixNano() / 1000000
+	for _, account := range fc.configs.GetAccounts() {
+		if account.Auth.ExpireTime == 0 || millis < account.Auth.ExpireTime {
+			continue
+		}
+		if millis < account.Auth.RefreshExpireTime {
+			config := mill.Config{}
+			accessToken, refreshToken, expireTime, refreshExpireTime, err := config.RefreshToken(account.Auth.RefreshToken)
+			if errors.Is(err, mill.ErrInvalidCredentials) {
+				log.Errorf("<router> Mill rejected the refresh token of account %s. Error: %v", account.Name, err)
+				account.Auth.RefreshExpireTime = 0
+				fc.configs.UpdateAccount(account)
+				fc.configs.SaveToFile()
+				fc.accountRefreshExpired(account)
+				continue
+			}
+			if err != nil {
+				log.Errorf("<router> Can't refresh tokens of account %s. Error: %v", account.Name, err)
+				continue
+			}
+			account.Auth.AccessToken, account.Auth.RefreshToken = accessToken, refreshToken
+			account.Auth.ExpireTime, account.Auth.RefreshExpireTime = expireTime, refreshExpireTime
+			fc.configs.UpdateAccount(account)
+			fc.configs.SaveToFile()
+			continue
+		}
+		fc.accountRefreshExpired(account)
+	}
+}
+
+func (fc *FromFimpRouter) accountRefreshExpired(account model.Account) {
+	fc.reloginMux.Lock()
+	lastAttempt, tried := fc.accountRelogin[account.ID]
+	retry := !tried || time.Since(lastAttempt) >= reloginRetryInterval
+	if retry {
+		fc.accountRelogin[account.ID] = time.Now()
+	}
+	fc.reloginMux.Unlock()
+	if !retry {
+		return
+	}
+	if fc.configs.GetAutoRelogin() && account.Username != "" && account.Password != "" {
+		log.Infof("<router> Refresh token of account %s has expired, logging in again", account.Name)
+		if err := fc.requestAuthCode(account.ID, nil); err == nil {
+			return
+		}
+	}
+	if account.AuthState == string(model.AuthStateReauthRequired) {
+		return
+	}
+	log.Errorf("<router> Refresh token of account %s has expired. Remove and add the account again", account.Name)
+	account.AuthState = string(model.AuthStateReauthRequired)
+	fc.configs.UpdateAccount(account)
+	fc.configs.SaveToFile()
+	val := map[string]string{
+		"auth_state": model.AuthStateReauthRequired,
+		"account":    account.ID,
+		"text":       "Mill login of account " + account.Name + " has expired. Please add the account again.",
+	}
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID}
+	msg := fimpgo.NewMessage("evt.auth.reauth_required", model.ServiceName, fimpgo.VTypeStrMap, val, nil, nil, nil)
+	fc.mqt.Publish(adr, msg)
+}
+
+// accountDevices returns the devices of an extra account from a saved device list.
+func accountDevices(list []interface{}, accountID string) []interface{} {
+	devices := []interface{}{}
+	for _, device := range list {
+		if owner, err := model.ParseDeviceAddress(model.DeviceAddressOf(device)); err == nil && owner.AccountID == accountID {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+func (fc *FromFimpRouter) publishAccountsReport(reqPayload *fimpgo.FimpMessage) {
+	report := []AccountReport{}
+	for _, account := range fc.configs.GetAccounts() {
+		report = append(report, AccountReport{ID: account.ID, Name: account.Name, AuthState: account.AuthState})
+	}
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID}
+	msg := fimpgo.NewMessage("evt.auth.accounts_report", model.ServiceName, fimpgo.VTypeObject, report, nil, nil, reqPayload)
+	if reqPayload == nil || fc.mqt.RespondToRequest(reqPayload, msg) != nil {
+		fc.mqt.Publish(adr, msg)
+	}
+}
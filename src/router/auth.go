@@ -0,0 +1,276 @@
+package router
+
+import (
+	"errors"
+	"time"
+
+	mill "github.com/futurehomeno/edge-mill-adapter/millapi"
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// authCodeProvider builds the auth code provider selected in configs.
+func (fc *FromFimpRouter) authCodeProvider() mill.AuthCodeProvider {
+	settings := fc.configs.GetAuthSettings()
+	switch settings.Provider {
+	case model.AuthProviderMillKey:
+		return &mill.MillKeyAuthCodeProvider{AccessKey: settings.MillAccessKey, SecretToken: settings.MillSecretToken}
+	case model.AuthProviderStatic:
+		return &mill.StaticAuthCodeProvider{Code: settings.StaticAuthCode}
+	default:
+		return &mill.PartnerAuthCodeProvider{URL: settings.PartnerAuthURL}
+	}
+}
+
+// requestAuthCode starts the Mill login of an account. Providers needing a hub token continue when auth-api
+// responds, see setAuthCode. Both paths end with cmd.auth.set_tokens, which exchanges the authorization code for tokens,
+// or with a failed login if no authorization code could be got.
+func (fc *FromFimpRouter) requestAuthCode(accountID string, reqPayload *fimpgo.FimpMessage) error {
+	provider := fc.authCodeProvider()
+	if provider.NeedsHubToken() {
+		adr, msg, err := model.HubTokenRequest(fc.instanceID)
+		if err != nil {
+			return err
+		}
+		fc.authMux.Lock()
+		fc.authRequests = append(withoutAuthRequest(fc.authRequests, accountID), authRequest{uid: msg.UID, accountID: accountID})
+		fc.authMux.Unlock()
+		fc.mqt.Publish(adr, msg)
+		return nil
+	}
+	fc.setAuthCode(provider, "", accountID, reqPayload)
+	return nil
+}
+
+// setAuthCode gets the authorization code from provider and continues the login.
+func (fc *FromFimpRouter) setAuthCode(provider mill.AuthCodeProvider, hubToken string, accountID string, reqPayload *fimpgo.FimpMessage) {
+	authCode, err := provider.AuthCode(hubToken)
+	if accountID == model.PrimaryAccountID {
+		fc.configs.SetAuthCode(authCode, hubToken)
+	} else if account, ok := fc.configs.GetAccount(accountID); ok {
+		account.Auth.AuthorizationCode = authCode
+		fc.configs.UpdateAccount(account)
+	}
+	if err != nil {
+		log.Error("<router> Can't get authorization code. Error: ", err)
+		fc.loginFailed(accountID, err, reqPayload)
+		return
+	}
+	fc.publishSetTokens(accountID, reqPayload)
+}
+
+// loginFailed reports a login that stopped before the authorization code could be exchanged for tokens.
+func (fc *FromFimpRouter) loginFailed(accountID string, err error, reqPayload *fimpgo.FimpMessage) {
+	if accountID == model.PrimaryAccountID {
+		fc.finishLogin(err, reqPayload)
+		return
+	}
+	account, ok := fc.configs.GetAccount(accountID)
+	if !ok {
+		log.Error("<router> Login failed for unknown account ", accountID)
+		return
+	}
+	fc.finishAccountLogin(account, err, reqPayload)
+}
+
+// authRequest is a hub token request sent to auth-api for the login of an account.
+type authRequest struct {
+	uid       string
+	accountID string
+}
+
+// withoutAuthRequest removes the pending request of an account, which is replaced when the account logs in again.
+func withoutAuthRequest(requests []authRequest, accountID string) []authRequest {
+	kept := []authRequest{}
+	for _, req := range requests {
+		if req.accountID != accountID {
+			kept = append(kept, req)
+		}
+	}
+	return kept
+}
+
+// takeAuthAccount returns the account waiting for the hub token in the auth-api response with the given correlation
+// id. Responses without one are matched with the oldest request. requested is false if this instance isn't waiting
+// for the response.
+func (fc *FromFimpRouter) takeAuthAccount(correlationID string) (accountID string, requested bool) {
+	fc.authMux.Lock()
+	defer fc.authMux.Unlock()
+	for i, req := range fc.authRequests {
+		if correlationID == "" || req.uid == correlationID {
+			fc.authRequests = append(fc.authRequests[:i:i], fc.authRequests[i+1:]...)
+			return req.accountID, true
+		}
+	}
+	return "", false
+}
+
+// publishSetTokens continues the login. The value is empty for the primary account, otherwise the account id.
+func (fc *FromFimpRouter) publishSetTokens(accountID string, reqPayload *fimpgo.FimpMessage) {
+	val := ""
+	if accountID != model.PrimaryAccountID {
+		val = accountID
+	}
+	msg := fimpgo.NewMessage("cmd.auth.set_tokens", model.ServiceName, fimpgo.VTypeString, val, nil, nil, reqPayload)
+	newadr := &fimpgo.Address{MsgType: fimpgo.MsgTypeCmd, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID}
+	fc.mqt.Publish(newadr, msg)
+}
+
+// login exchanges the authorization code for tokens. The returned error tells why login failed.
+func (fc *FromFimpRouter) login() error {
+	auth := fc.configs.GetAuth()
+	if auth.AuthorizationCode == "" {
+		return mill.ErrAuthCodeMissing
+	}
+	config := mill.Config{}
+	username, password := fc.configs.GetCredentials()
+	var err error
+	auth.AccessToken, auth.RefreshToken, auth.ExpireTime, auth.RefreshExpireTime, err = config.NewClient(auth.AuthorizationCode, password, username)
+	fc.configs.SetAuth(auth)
+	if !fc.configs.GetAutoRelogin() {
+		fc.configs.ClearCredentials()
+	}
+	fc.configs.SaveToFile()
+	fc.states.SaveToFile()
+	return err
+}
+
+// finishLogin reports the result of a login with the primary account, and includes its devices if it succeeded.
+func (fc *FromFimpRouter) finishLogin(err error, reqPayload *fimpgo.FimpMessage) {
+	relogin := fc.finishRelogin()
+	status := loginStatus(err)
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID}
+
+	if relogin {
+		// Automatic re-login, devices are already included and nobody is waiting for a response.
+		if err == nil {
+			log.Info("<router> Logged in to Mill again")
+			fc.appLifecycle.SetAuthState(model.AuthStateAuthenticated)
+			fc.appLifecycle.SetConnectionState(model.ConnStateConnected)
+			fc.clearReauth()
+		} else {
+			log.Error("<router> Automatic re-login failed. Error: ", err)
+			fc.requireReauth()
+		}
+		return
+	}
+
+	loginval := map[string]interface{}{
+		"errors":  nil,
+		"success": true,
+	}
+	if err == nil {
+		fc.appLifecycle.SetAuthState(model.AuthStateAuthenticated)
+		fc.appLifecycle.SetConfigState(model.ConfigStateConfigured)
+		fc.appLifecycle.SetConnectionState(model.ConnStateConnected)
+		if fc.appLifecycle.AppState() != model.AppStateRunning {
+			fc.appLifecycle.SetAppState(model.AppStateRunning, nil)
+		}
+		fc.clearReauth()
+		log.Debug("All tokens received and saved.")
+	} else {
+		fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
+		log.Infof("Login failed, please try again. Error code: %s, error: %v", status.ErrorCode, err)
+		loginval["errors"] = status.ErrorText
+		loginval["success"] = false
+	}
+	newadr, adrErr := fimpgo.NewAddressFromString("pt:j1/mt:rsp/rt:cloud/rn:remote-client/ad:smarthome-app")
+	if adrErr != nil {
+		log.Debug("Could not make login response topic")
+	}
+	msg := fimpgo.NewMessage("evt.pd7.response", "vinculum", fimpgo.VTypeObject, loginval, nil, nil, reqPayload)
+	msg.CorrelationID = fc.configs.GetUID()
+	fc.mqt.Publish(newadr, msg)
+
+	msg = fimpgo.NewMessage("evt.auth.status_report", model.ServiceName, fimpgo.VTypeObject, status, nil, nil, reqPayload)
+	if reqPayload == nil || fc.mqt.RespondToRequest(reqPayload, msg) != nil {
+		// if response topic is not set , sending back to default application event topic
+		fc.mqt.Publish(adr, msg)
+	}
+	if status.ErrorCode != "" {
+		return
+	}
+
+	if _, err := fc.syncDevices(reqPayload); err != nil {
+		log.Error("Can't sync devices after login. Error: ", err)
+	}
+	msg = fimpgo.NewMessage("evt.network.get_all_nodes_report", model.ServiceName, fimpgo.VTypeObject, fc.nodesReport(), nil, nil, reqPayload)
+	if reqPayload == nil || fc.mqt.RespondToRequest(reqPayload, msg) != nil {
+		// if response topic is not set , sending back to default application event topic
+		fc.mqt.Publish(adr, msg)
+	}
+	fc.configs.SaveToFile()
+}
+
+// loginStatus maps a login error to the status reported to the user.
+func loginStatus(err error) model.AuthStatus {
+	if err == nil {
+		return model.AuthStatus{Status: model.AuthStateAuthenticated}
+	}
+	status := model.AuthStatus{Status: model.AuthStateNotAuthenticated}
+	switch {
+	case errors.Is(err, mill.ErrUnreachable):
+		status.ErrorCode = model.AuthErrorNetwork
+		status.ErrorText = "Can't reach Mill. Check the internet connection and try again later."
+	case errors.Is(err, mill.ErrRateLimited):
+		status.ErrorCode = model.AuthErrorRateLimited
+		status.ErrorText = "Too many login attempts. Wait a few minutes and try again."
+	case errors.Is(err, mill.ErrInvalidCredentials):
+		status.ErrorCode = model.AuthErrorInvalidCredentials
+		status.ErrorText = "Wrong username or password"
+	case errors.Is(err, mill.ErrAuthCodeMissing):
+		status.ErrorCode = model.AuthErrorAuthCodeMissing
+		status.ErrorText = "Didn't get an authorization code for Mill. Please try again."
+	case errors.Is(err, mill.ErrPartnerAPI):
+		status.ErrorCode = model.AuthErrorPartnerAPI
+		status.ErrorText = "Futurehome couldn't start the Mill login. Please try again later."
+	default:
+		status.ErrorCode = model.AuthErrorMillAPI
+		status.ErrorText = "Mill rejected the login: " + err.Error()
+	}
+	return status
+}
+
+// logout excludes all devices and wipes credentials, tokens, devices and queued commands from memory and disk.
+// Mill's open API has no endpoint for revoking tokens, so they are only wiped from the hub. Mill keeps accepting the
+// access token until it expires within two hours, and the refresh token until its own expiry time.
+func (fc *FromFimpRouter) logout(reqPayload *fimpgo.FimpMessage) {
+	fc.listsMux.Lock()
+	defer fc.listsMux.Unlock()
+	fc.refreshMux.Lock()
+	defer fc.refreshMux.Unlock()
+
+	fc.stopInclusion()
+	fc.excludeAllDevices(reqPayload)
+	fc.states.ClearIgnoredDevices()
+
+	fc.finishRelogin()
+	fc.authMux.Lock()
+	fc.authRequests = nil
+	fc.authMux.Unlock()
+	fc.cancelPendingSetpoints()
+	if err := fc.queue.Clear(); err != nil {
+		log.Error("<router> Can't clear command queue. Error: ", err)
+	}
+	fc.configs.ClearSecrets()
+	if err := fc.configs.SaveToFile(); err != nil {
+		log.Error("<router> Can't save configs after logout. Error: ", err)
+	}
+	fc.states.ClearCollections()
+	if err := fc.states.SaveToFile(); err != nil {
+		log.Error("<router> Can't save states after logout. Error: ", err)
+	}
+
+	fc.appLifecycle.SetConfigState(model.ConfigStateNotConfigured)
+	fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
+	fc.appLifecycle.SetConnectionState(model.ConnStateDisconnected)
+	fc.reloginMux.Lock()
+	fc.relogin = reloginState{}
+	fc.accountRelogin = make(map[string]time.Time)
+	fc.reloginMux.Unlock()
+
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID}
+	msg := fimpgo.NewMessage("evt.auth.status_report", model.ServiceName, fimpgo.VTypeObject, model.AuthStatus{Status: model.AuthStateNotAuthenticated}, nil, nil, reqPayload)
+	fc.mqt.Publish(adr, msg)
+}
@@ -0,0 +1,66 @@
+package router
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// binarySet turns a Mill socket on or off.
+func (fc *FromFimpRouter) binarySet(oldMsg *fimpgo.Message, addr string) {
+	val, err := oldMsg.Payload.GetBoolValue()
+	if err != nil {
+		fc.replyError(oldMsg, invalidPayload(err))
+		return
+	}
+	log.Debug("Trying to turn socket on: ", val)
+
+	cmd := model.QueuedCommand{DeviceID: addr, Service: "out_bin_switch", Type: oldMsg.Payload.Type, Value: map[string]string{"value": strconv.FormatBool(val)}}
+	queued, err := fc.sendCommand(cmd)
+	if queued {
+		log.Info("Mill is unreachable, socket will be turned on: ", val, " when connection is back")
+		return
+	}
+	if err != nil {
+		fc.replyError(oldMsg, err)
+		return
+	}
+
+	fc.reportCommand(cmd, oldMsg.Payload)
+	log.Info("Socket switched, on: ", val)
+}
+
+// binaryReport publishes the on/off state of a Mill socket.
+func (fc *FromFimpRouter) binaryReport(reqMsg *fimpgo.Message, addr string) {
+	found, ok := fc.states.DeviceByID(addr)
+	if !ok {
+		fc.replyError(reqMsg, fmt.Errorf("%w: %s", model.ErrDeviceNotFound, addr))
+		return
+	}
+	device := reflect.ValueOf(found)
+	val := device.FieldByName("PowerStatus").Interface().(int) == 1
+
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID, ServiceName: "out_bin_switch", ServiceAddress: addr}
+	msg := fimpgo.NewMessage("evt.binary.report", "out_bin_switch", fimpgo.VTypeBool, val, nil, nil, reqMsg.Payload)
+	fc.mqt.Publish(adr, msg)
+}
+
+// meterReport publishes the energy used by a Mill socket. Mill only reports the energy used this month, so the
+// running total is kept in states.
+func (fc *FromFimpRouter) meterReport(reqMsg *fimpgo.Message, addr string) {
+	found, ok := fc.states.DeviceByID(addr)
+	if !ok {
+		fc.replyError(reqMsg, fmt.Errorf("%w: %s", model.ErrDeviceNotFound, addr))
+		return
+	}
+	device := reflect.ValueOf(found)
+	val := fc.states.AddMeterReading(addr, float64(device.FieldByName("CurrentMonthKwh").Interface().(int)))
+
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID, ServiceName: "meter_elec", ServiceAddress: addr}
+	msg := fimpgo.NewMessage("evt.meter.report", "meter_elec", fimpgo.VTypeFloat, val, fimpgo.Props{"unit": "kWh"}, nil, reqMsg.Payload)
+	fc.mqt.Publish(adr, msg)
+}
@@ -0,0 +1,205 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	mill "github.com/futurehomeno/edge-mill-adapter/millapi"
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// queueReplayInterval is how often queued commands are retried while the Mill cloud is unreachable.
+const queueReplayInterval = 30 * time.Second
+
+// sendCommand delivers a control command to Mill. If the Mill cloud can't be reached the command is queued
+// for replay and queued is set to true. A setpoint for the device still waiting in the debounce window was
+// received first, so it is sent before the command.
+func (fc *FromFimpRouter) sendCommand(cmd model.QueuedCommand) (queued bool, err error) {
+	lock := fc.deviceLock(cmd.DeviceID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	fc.flushPendingSetpoint(cmd.DeviceID)
+	return fc.sendCommandLocked(cmd)
+}
+
+// sendCommandLocked is sendCommand for callers holding the device lock.
+func (fc *FromFimpRouter) sendCommandLocked(cmd model.QueuedCommand) (queued bool, err error) {
+	err = fc.executeCommand(cmd)
+	if errors.Is(err, mill.ErrUnreachable) {
+		log.Warnf("<queue> Mill is unreachable, queueing %s for device %s", cmd.Type, cmd.DeviceID)
+		if qErr := fc.queue.Add(cmd); qErr != nil {
+			log.Error("<queue> Can't save command queue. Error: ", qErr)
+		}
+		return true, err
+	}
+	if err == nil {
+		// Older queued command for the same device must not overwrite this one when connection is back.
+		fc.queue.Delivered(cmd)
+		fc.triggerReplay()
+	}
+	return false, err
+}
+
+// executeCommand sends a single command to the Mill API.
+func (fc *FromFimpRouter) executeCommand(cmd model.QueuedCommand) error {
+	config := mill.Config{}
+	addr, err := model.ParseDeviceAddress(cmd.DeviceID)
+	if err != nil {
+		return err
+	}
+	accessToken := fc.configs.AccessTokenFor(addr.AccountID)
+	if accessToken == "" {
+		return errNotAuthenticated
+	}
+	deviceID := addr.MillID()
+	switch cmd.Type {
+	case "cmd.setpoint.set":
+		newTemp, err := setpointTemp(cmd.Value["temp"])
+		if err != nil {
+			return err
+		}
+		if err = config.TempControl(accessToken, deviceID, newTemp); err != nil {
+			return err
+		}
+		fc.states.SetSetpoint(cmd.DeviceID, newTemp)
+		return nil
+	case "cmd.mode.set":
+		// Setpoint isn't reported by Mill, so the last setpoint sent by the adapter is kept unless a queued setpoint
+		// was merged into the command.
+		holdTemp := fc.states.GetSetpoint(cmd.DeviceID)
+		if temp, ok := cmd.Value["temp"]; ok {
+			if holdTemp, err = setpointTemp(temp); err != nil {
+				return err
+			}
+		}
+		if err = config.ModeControl(accessToken, deviceID, holdTemp, cmd.Value["mode"]); err != nil {
+			return err
+		}
+		if holdTemp != "" {
+			fc.states.SetSetpoint(cmd.DeviceID, holdTemp)
+		}
+		return nil
+	case "cmd.binary.set":
+		on, err := strconv.ParseBool(cmd.Value["value"])
+		if err != nil {
+			return err
+		}
+		return config.SwitchControl(accessToken, deviceID, on)
+	}
+	return fmt.Errorf("unsupported command %s", cmd.Type)
+}
+
+// reportCommand publishes the new device state after a command has been delivered.
+func (fc *FromFimpRouter) reportCommand(cmd model.QueuedCommand, reqMsg *fimpgo.FimpMessage) {
+	var msg *fimpgo.FimpMessage
+	switch cmd.Type {
+	case "cmd.setpoint.set":
+		msg = fimpgo.NewMessage("evt.setpoint.report", cmd.Service, fimpgo.VTypeStrMap, cmd.Value, nil, nil, reqMsg)
+	case "cmd.mode.set":
+		if _, ok := cmd.Value["temp"]; ok {
+			setpoint := model.QueuedCommand{DeviceID: cmd.DeviceID, Service: cmd.Service, Type: "cmd.setpoint.set", Value: setpointValue(cmd.Value)}
+			fc.reportCommand(setpoint, reqMsg)
+		}
+		msg = fimpgo.NewMessage("evt.mode.report", cmd.Service, fimpgo.VTypeString, cmd.Value["mode"], nil, nil, reqMsg)
+	case "cmd.binary.set":
+		on, _ := strconv.ParseBool(cmd.Value["value"])
+		msg = fimpgo.NewMessage("evt.binary.report", cmd.Service, fimpgo.VTypeBool, on, nil, nil, reqMsg)
+	default:
+		return
+	}
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID, ServiceName: cmd.Service, ServiceAddress: cmd.DeviceID}
+	fc.mqt.Publish(adr, msg)
+}
+
+// reportQueueFailure lets the hub know that a queued command was never delivered.
+func (fc *FromFimpRouter) reportQueueFailure(cmd model.QueuedCommand, code string) {
+	props := fimpgo.Props{"cmd": cmd.Type}
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID, ServiceName: cmd.Service, ServiceAddress: cmd.DeviceID}
+	msg := fimpgo.NewMessage("evt.error.report", cmd.Service, fimpgo.VTypeString, code, props, nil, nil)
+	fc.mqt.Publish(adr, msg)
+}
+
+func (fc *FromFimpRouter) triggerReplay() {
+	if fc.queue.Len() == 0 {
+		return
+	}
+	select {
+	case fc.replayCh <- struct{}{}:
+	default:
+	}
+}
+
+func (fc *FromFimpRouter) runQueueReplay() {
+	ticker := time.NewTicker(queueReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-fc.replayCh:
+		}
+		fc.replayQueue()
+	}
+}
+
+// replayQueue delivers queued commands in order and stops at the first one that fails because Mill is still unreachable.
+func (fc *FromFimpRouter) replayQueue() {
+	for _, cmd := range fc.queue.RemoveExpired(time.Now()) {
+		log.Warnf("<queue> %s for device %s expired after %d attempts", cmd.Type, cmd.DeviceID, cmd.Attempts)
+		fc.reportQueueFailure(cmd, "QUEUED_COMMAND_EXPIRED")
+	}
+	for {
+		cmd, ok := fc.queue.Peek()
+		if !ok {
+			return
+		}
+		lock := fc.deviceLock(cmd.DeviceID)
+		lock.Lock()
+		if !fc.queue.Contains(cmd.ID) {
+			// A newer command for the device was delivered while waiting for the lock.
+			lock.Unlock()
+			continue
+		}
+		err := fc.executeCommand(cmd)
+		if errors.Is(err, mill.ErrUnreachable) {
+			fc.queue.MarkAttempt(cmd.ID)
+			lock.Unlock()
+			return
+		}
+		fc.queue.Remove(cmd.ID)
+		lock.Unlock()
+
+		if err != nil {
+			log.Errorf("<queue> Queued %s for device %s was rejected. Error: %v", cmd.Type, cmd.DeviceID, err)
+			fc.reportQueueFailure(cmd, "QUEUED_COMMAND_FAILED")
+			continue
+		}
+		log.Infof("<queue> Queued %s for device %s delivered", cmd.Type, cmd.DeviceID)
+		fc.reportCommand(cmd, nil)
+	}
+}
+
+// setpointValue returns the setpoint part of the value of a thermostat command.
+func setpointValue(value map[string]string) map[string]string {
+	setpoint := map[string]string{}
+	for key, val := range value {
+		if key != "mode" {
+			setpoint[key] = val
+		}
+	}
+	return setpoint
+}
+
+// setpointTemp converts a FIMP setpoint to the whole degrees Mill accepts.
+func setpointTemp(temp string) (string, error) {
+	valFloat, err := strconv.ParseFloat(temp, 64)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(int(math.Ceil(valFloat))), nil
+}
@@ -1,36 +1,81 @@
 package router
 
 import (
-	"math"
-	"strconv"
+	"errors"
+	"fmt"
 
-	mill "github.com/futurehomeno/edge-mill-adapter/millapi"
 	"github.com/futurehomeno/edge-mill-adapter/model"
 	"github.com/futurehomeno/fimpgo"
 	log "github.com/sirupsen/logrus"
 )
 
-func (fc *FromFimpRouter) setpointSet(oldMsg *fimpgo.Message, config mill.Config) {
-	addr := oldMsg.Addr.ServiceAddress
+// errNoSetpoint is reported when no setpoint has been set through the adapter yet.
+var errNoSetpoint = errors.New("setpoint isn't known")
 
+func (fc *FromFimpRouter) setpointSet(oldMsg *fimpgo.Message, addr string) {
 	val, _ := oldMsg.Payload.GetStrMapValue()
-	valFloat, err := strconv.ParseFloat(val["temp"], 64)
-	if err != nil {
+	if _, err := setpointTemp(val["temp"]); err != nil {
 		log.Error("Could not convert to float, something wrong in setpoint value. Declining request, value: ", val["temp"], ", error: ", err)
+		fc.replyError(oldMsg, invalidPayload(err))
 		return
 	}
+	fc.debounceSetpoint(addr, oldMsg)
+}
 
-	newTemp := strconv.Itoa(int(math.Ceil(valFloat)))
-	deviceID := addr
+// setpointSend sends the setpoint left after debouncing to Mill. The device lock must be held.
+func (fc *FromFimpRouter) setpointSend(oldMsg *fimpgo.Message, addr string) {
+	val, _ := oldMsg.Payload.GetStrMapValue()
+	newTemp, _ := setpointTemp(val["temp"])
 
-	if err := config.TempControl(fc.configs.Auth.AccessToken, deviceID, newTemp); err != nil {
-		log.Error("Something went wrong when changing temperature, err: ", err)
+	cmd := model.QueuedCommand{DeviceID: addr, Service: "thermostat", Type: oldMsg.Payload.Type, Value: val}
+	queued, err := fc.sendCommandLocked(cmd)
+	if queued {
+		log.Info("Mill is unreachable, setpoint ", newTemp, " will be sent when connection is back")
+		return
+	}
+	if err != nil {
+		fc.replyError(oldMsg, err)
 		return
 	}
 
-	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "thermostat", ServiceAddress: addr}
-	msg := fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, val, nil, nil, oldMsg.Payload)
-	fc.mqt.Publish(adr, msg)
+	fc.reportCommand(cmd, oldMsg.Payload)
 	log.Info("Temperature setpoint updated, new setpoint ", newTemp)
 	return
 }
+
+// setpointReport publishes the last setpoint sent to a device. Mill doesn't report the setpoint of heaters in rooms,
+// so only setpoints set through the adapter are known.
+func (fc *FromFimpRouter) setpointReport(reqMsg *fimpgo.Message, addr string) {
+	temp := fc.states.GetSetpoint(addr)
+	if temp == "" {
+		fc.replyError(reqMsg, fmt.Errorf("%w for %s", errNoSetpoint, addr))
+		return
+	}
+	val := map[string]string{"type": "heat", "temp": temp, "unit": "C"}
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID, ServiceName: "thermostat", ServiceAddress: addr}
+	msg := fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, val, nil, nil, reqMsg.Payload)
+	fc.mqt.Publish(adr, msg)
+}
+
+func (fc *FromFimpRouter) modeSet(oldMsg *fimpgo.Message, addr string) {
+	val, err := oldMsg.Payload.GetStringValue()
+	if err != nil {
+		fc.replyError(oldMsg, invalidPayload(err))
+		return
+	}
+	log.Debug("Trying to set new mode: ", val)
+
+	cmd := model.QueuedCommand{DeviceID: addr, Service: "thermostat", Type: oldMsg.Payload.Type, Value: map[string]string{"mode": val}}
+	queued, err := fc.sendCommand(cmd)
+	if queued {
+		log.Info("Mill is unreachable, mode ", val, " will be set when connection is back")
+		return
+	}
+	if err != nil {
+		fc.replyError(oldMsg, err)
+		return
+	}
+
+	fc.reportCommand(cmd, oldMsg.Payload)
+	log.Info("Mode updated, new mode: ", val)
+}
@@ -0,0 +1,73 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// setpointDebounceWindow is how long setpoint commands for a device are collected before the latest one is sent.
+// Dragging the temperature slider in the app produces a burst of cmd.setpoint.set messages.
+const setpointDebounceWindow = 1500 * time.Millisecond
+
+// pendingSetpoint holds the latest setpoint command received for a device within the debounce window.
+type pendingSetpoint struct {
+	msg       *fimpgo.Message
+	coalesced int
+}
+
+// debounceSetpoint schedules msg to be sent after the debounce window. A newer command for the same device
+// received before the window ends replaces the pending one.
+func (fc *FromFimpRouter) debounceSetpoint(deviceID string, msg *fimpgo.Message) {
+	fc.pendingMux.Lock()
+	defer fc.pendingMux.Unlock()
+	if pending, ok := fc.pendingSetpoints[deviceID]; ok {
+		pending.msg = msg
+		pending.coalesced++
+		return
+	}
+	fc.pendingSetpoints[deviceID] = &pendingSetpoint{msg: msg}
+	time.AfterFunc(setpointDebounceWindow, func() {
+		lock := fc.deviceLock(deviceID)
+		lock.Lock()
+		defer lock.Unlock()
+		fc.flushPendingSetpoint(deviceID)
+	})
+}
+
+// flushPendingSetpoint sends the setpoint waiting for the debounce window of a device, if there is one.
+// The device lock must be held, so no other command for the device can be sent in between.
+func (fc *FromFimpRouter) flushPendingSetpoint(deviceID string) {
+	fc.pendingMux.Lock()
+	pending := fc.pendingSetpoints[deviceID]
+	delete(fc.pendingSetpoints, deviceID)
+	fc.pendingMux.Unlock()
+	if pending == nil {
+		return
+	}
+	if pending.coalesced > 0 {
+		log.Debugf("Coalesced %d setpoint commands for device %s", pending.coalesced, deviceID)
+	}
+	fc.setpointSend(pending.msg, deviceID)
+}
+
+// cancelPendingSetpoints drops setpoint commands waiting for the debounce window to end.
+func (fc *FromFimpRouter) cancelPendingSetpoints() {
+	fc.pendingMux.Lock()
+	fc.pendingSetpoints = make(map[string]*pendingSetpoint)
+	fc.pendingMux.Unlock()
+}
+
+// deviceLock returns the lock used to serialise commands sent to a device.
+func (fc *FromFimpRouter) deviceLock(deviceID string) *sync.Mutex {
+	fc.deviceLocksMux.Lock()
+	defer fc.deviceLocksMux.Unlock()
+	lock, ok := fc.deviceLocks[deviceID]
+	if !ok {
+		lock = &sync.Mutex{}
+		fc.deviceLocks[deviceID] = lock
+	}
+	return lock
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+
+	mill "github.com/futurehomeno/edge-mill-adapter/millapi"
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// Error codes reported in evt.error.report.
+const (
+	ErrCodeInvalidAddress   = "INVALID_ADDRESS"
+	ErrCodeUnknownDevice    = "UNKNOWN_DEVICE"
+	ErrCodeInvalidPayload   = "INVALID_PAYLOAD"
+	ErrCodeNotAuthenticated = "NOT_AUTHENTICATED"
+	ErrCodeAPI              = "API_ERROR"
+	ErrCodeFailed           = "FAILED"
+)
+
+var (
+	errInvalidPayload   = errors.New("invalid payload")
+	errNotAuthenticated = errors.New("not logged in to Mill")
+)
+
+// invalidPayload wraps an error from reading a message value.
+func invalidPayload(err error) error {
+	return fmt.Errorf("%w: %v", errInvalidPayload, err)
+}
+
+// errorCode finds the evt.error.report code of an error.
+func errorCode(err error) string {
+	var apiErr *mill.APIError
+	switch {
+	case errors.Is(err, model.ErrInvalidAddress):
+		return ErrCodeInvalidAddress
+	case errors.Is(err, model.ErrDeviceNotFound):
+		return ErrCodeUnknownDevice
+	case errors.Is(err, errInvalidPayload):
+		return ErrCodeInvalidPayload
+	case errors.Is(err, errNotAuthenticated), errors.Is(err, mill.ErrInvalidCredentials), errors.Is(err, mill.ErrAuthCodeMissing):
+		return ErrCodeNotAuthenticated
+	case errors.As(err, &apiErr), errors.Is(err, mill.ErrUnreachable), errors.Is(err, mill.ErrRateLimited), errors.Is(err, mill.ErrPartnerAPI):
+		return ErrCodeAPI
+	}
+	return ErrCodeFailed
+}
+
+// replyError answers a command that failed with evt.error.report. The report goes to the response topic of the
+// request if it has one, otherwise it is published as an event on the address the request was sent to.
+func (fc *FromFimpRouter) replyError(reqMsg *fimpgo.Message, err error) {
+	code := errorCode(err)
+	log.Errorf("<router> %s failed for %q with %s. Error: %v", reqMsg.Payload.Type, reqMsg.Addr.ServiceAddress, code, err)
+	props := fimpgo.Props{"cmd": reqMsg.Payload.Type, "msg": err.Error()}
+	msg := fimpgo.NewMessage("evt.error.report", reqMsg.Payload.Service, fimpgo.VTypeString, code, props, nil, reqMsg.Payload)
+	if fc.mqt.RespondToRequest(reqMsg.Payload, msg) == nil {
+		return
+	}
+	adr := *reqMsg.Addr
+	adr.MsgType = fimpgo.MsgTypeEvt
+	fc.mqt.Publish(&adr, msg)
+}
@@ -0,0 +1,87 @@
+package router
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// extendedSetRequest is the value of cmd.config.extended_set. Settings that aren't sent are nil and left alone.
+type extendedSetRequest struct {
+	PollTimeMin  *string `json:"poll_time_min"`
+	AuthProvider *string `json:"auth_provider"`
+	// MillAccessKey and MillSecretToken aren't part of the configs json, empty values keep the stored ones.
+	MillAccessKey       *string  `json:"mill_access_key"`
+	MillSecretToken     *string  `json:"mill_secret_token"`
+	RestoreDevice       *string  `json:"restore_device"`
+	AutoRelogin         *bool    `json:"auto_relogin"`
+	SelectedHomes       []string `json:"selected_homes"`
+	KeepFuturehomeNames *bool    `json:"keep_futurehome_names"`
+}
+
+// applyExtendedSet saves the settings sent with cmd.config.extended_set. Invalid settings are skipped, the others
+// are still applied, and the first error is returned. homesChanged tells if devices must be synced.
+func (fc *FromFimpRouter) applyExtendedSet(req extendedSetRequest, reqPayload *fimpgo.FimpMessage) (homesChanged bool, confErr error) {
+	if req.PollTimeMin != nil {
+		if _, err := strconv.Atoi(*req.PollTimeMin); err != nil {
+			log.Error(fmt.Sprintf("%q is not a number or contains illegal symbols.", *req.PollTimeMin))
+			if *req.PollTimeMin != "" {
+				confErr = invalidPayload(fmt.Errorf("poll time %q is not a number", *req.PollTimeMin))
+			}
+		} else {
+			fc.configs.SetPollTimeMin(*req.PollTimeMin)
+			log.Info("App reconfigured, new poll time: ", *req.PollTimeMin)
+		}
+	}
+	if req.AuthProvider != nil {
+		switch *req.AuthProvider {
+		case model.AuthProviderPartner, model.AuthProviderMillKey, model.AuthProviderStatic:
+			fc.configs.SetAuthProvider(*req.AuthProvider)
+		case "":
+		default:
+			log.Errorf("Unknown auth provider %q", *req.AuthProvider)
+			if confErr == nil {
+				confErr = invalidPayload(fmt.Errorf("unknown auth provider %q", *req.AuthProvider))
+			}
+		}
+	}
+	if req.MillAccessKey != nil || req.MillSecretToken != nil {
+		accessKey, secretToken := fc.configs.GetMillKey()
+		if req.MillAccessKey != nil && *req.MillAccessKey != "" {
+			accessKey = *req.MillAccessKey
+		}
+		if req.MillSecretToken != nil && *req.MillSecretToken != "" {
+			secretToken = *req.MillSecretToken
+		}
+		fc.configs.SetMillKey(accessKey, secretToken)
+	}
+	if req.RestoreDevice != nil && *req.RestoreDevice != "" {
+		if err := fc.restoreDevice(*req.RestoreDevice, reqPayload); err != nil {
+			log.Error("Can't restore device. Error: ", err)
+			if confErr == nil {
+				confErr = err
+			}
+		}
+	}
+	if req.AutoRelogin != nil && *req.AutoRelogin != fc.configs.GetAutoRelogin() {
+		fc.configs.SetAutoRelogin(*req.AutoRelogin)
+		if !*req.AutoRelogin {
+			// Credentials are only kept for automatic re-login.
+			fc.configs.ClearCredentials()
+		}
+		log.Info("Auto re-login set to ", *req.AutoRelogin)
+	}
+	if req.SelectedHomes != nil && !sameStrings(req.SelectedHomes, fc.configs.GetSelectedHomes()) {
+		fc.configs.SetSelectedHomes(req.SelectedHomes)
+		log.Info("Selected Mill homes set to ", req.SelectedHomes)
+		homesChanged = true
+	}
+	if req.KeepFuturehomeNames != nil && *req.KeepFuturehomeNames != fc.configs.GetKeepFuturehomeNames() {
+		fc.configs.SetKeepFuturehomeNames(*req.KeepFuturehomeNames)
+		log.Info("Keep Futurehome names set to ", *req.KeepFuturehomeNames)
+	}
+	return homesChanged, confErr
+}
@@ -1,18 +1,16 @@
 package router
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
 	"reflect"
-	"strconv"
+	"sync"
 	"time"
 
-	"strings"
-
 	"github.com/futurehomeno/fimpgo"
 	log "github.com/sirupsen/logrus"
 
-	mill "github.com/futurehomeno/edge-mill-adapter/millapi"
 	"github.com/futurehomeno/edge-mill-adapter/model"
 )
 
@@ -23,6 +21,26 @@ type FromFimpRouter struct {
 	appLifecycle *model.Lifecycle
 	configs      *model.Configs
 	states       *model.States
+	queue        *model.CommandQueue
+	replayCh     chan struct{}
+
+	pendingMux       sync.Mutex
+	pendingSetpoints map[string]*pendingSetpoint
+	deviceLocksMux   sync.Mutex
+	deviceLocks      map[string]*sync.Mutex
+
+	workers         []chan *fimpgo.Message
+	queueFullPolicy string
+	stats           routerStats
+	refreshMux      sync.Mutex
+	listsMux        sync.Mutex
+	reloginMux      sync.Mutex
+	relogin         reloginState
+	accountRelogin  map[string]time.Time
+	authMux         sync.Mutex
+	authRequests    []authRequest
+	inclusionMux    sync.Mutex
+	inclusionStop   chan struct{}
 }
 
 type ListReportRecord struct {
@@ -30,10 +48,16 @@ type ListReportRecord struct {
 	Alias          string `json:"alias"`
 	WakeupInterval string `json:"wakeup_int"`
 	PowerSource    string `json:"power_source"`
+	Home           string `json:"home,omitempty"`
+	Room           string `json:"room,omitempty"`
+	Independent    bool   `json:"independent"`
 }
 
-func NewFromFimpRouter(mqt *fimpgo.MqttTransport, appLifecycle *model.Lifecycle, configs *model.Configs, states *model.States) *FromFimpRouter {
-	fc := FromFimpRouter{inboundMsgCh: make(fimpgo.MessageCh, 5), mqt: mqt, appLifecycle: appLifecycle, configs: configs, states: states}
+func NewFromFimpRouter(mqt *fimpgo.MqttTransport, appLifecycle *model.Lifecycle, configs *model.Configs, states *model.States, queue *model.CommandQueue) *FromFimpRouter {
+	fc := FromFimpRouter{inboundMsgCh: make(fimpgo.MessageCh, 20), mqt: mqt, instanceID: configs.GetInstanceAddress(), appLifecycle: appLifecycle, configs: configs, states: states, queue: queue, replayCh: make(chan struct{}, 1)}
+	fc.pendingSetpoints = make(map[string]*pendingSetpoint)
+	fc.deviceLocks = make(map[string]*sync.Mutex)
+	fc.accountRelogin = make(map[string]time.Time)
 	fc.mqt.RegisterChannel("ch1", fc.inboundMsgCh)
 	return &fc
 }
@@ -43,245 +67,144 @@ func (fc *FromFimpRouter) Start() {
 	// TODO: Choose either adapter or app topic
 
 	// ------ Adapter topics ---------------------------------------------
-	fc.mqt.Subscribe(fmt.Sprintf("pt:j1/+/rt:dev/rn:%s/ad:1/#", model.ServiceName))
-	fc.mqt.Subscribe(fmt.Sprintf("pt:j1/+/rt:ad/rn:%s/ad:1", model.ServiceName))
+	fc.mqt.Subscribe(fmt.Sprintf("pt:j1/+/rt:dev/rn:%s/ad:%s/#", model.ServiceName, fc.instanceID))
+	fc.mqt.Subscribe(fmt.Sprintf("pt:j1/+/rt:ad/rn:%s/ad:%s", model.ServiceName, fc.instanceID))
+	// Hub tokens are requested with a response topic for this instance, but auth-api may answer on its event topic.
 	fc.mqt.Subscribe("pt:j1/mt:evt/rt:cloud/rn:auth-api/ad:1")
 
 	// ------ Application topic -------------------------------------------
-	//fc.mqt.Subscribe(fmt.Sprintf("pt:j1/+/rt:app/rn:%s/ad:1",model.ServiceName))
+	//fc.mqt.Subscribe(fmt.Sprintf("pt:j1/+/rt:app/rn:%s/ad:%s",model.ServiceName, fc.instanceID))
 
+	fc.startWorkers()
 	go func(msgChan fimpgo.MessageCh) {
 		for {
 			select {
 			case newMsg := <-msgChan:
-				fc.routeFimpMessage(newMsg)
+				fc.dispatch(newMsg)
 			}
 		}
 	}(fc.inboundMsgCh)
+
+	go fc.runQueueReplay()
 }
 
 func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
-	config := mill.Config{}
-	client := mill.Client{}
-	ns := model.NetworkService{}
-
-	if fc.configs.IsConfigured() {
-		fc.appLifecycle.SetConnectionState(model.ConnStateConnected)
-		fc.appLifecycle.SetConfigState(model.ConfigStateConfigured)
-	} else {
-		fc.appLifecycle.SetConfigState(model.ConfigStateNotConfigured)
-		fc.appLifecycle.SetConnectionState(model.ConnStateDisconnected)
-	}
-
-	// Get new tokens if expires_in is exceeded. expireTime lasts for two hours, refreshExpireTime lasts for 30 days.
-	if fc.configs.Auth.ExpireTime != 0 {
-		millis := time.Now().UnixNano() / 1000000
-		if millis > fc.configs.Auth.ExpireTime && millis < fc.configs.Auth.RefreshExpireTime {
-			var err error
-			accessToken, refreshToken, expireTime, refreshExpireTime, err := config.RefreshToken(fc.configs.Auth.RefreshToken)
-			if err == nil {
-				fc.configs.Auth.AccessToken = accessToken
-				fc.configs.Auth.RefreshToken = refreshToken
-				fc.configs.Auth.ExpireTime = expireTime
-				fc.configs.Auth.RefreshExpireTime = refreshExpireTime
-			} else {
-				fc.configs.Auth.ExpireTime = 1
-			}
-			fc.states.SaveToFile()
-		} else if millis > fc.configs.Auth.RefreshExpireTime {
-			log.Error("30 day refreshExpireTime has expired. Restard adapter or send cmd.auth.login")
-		}
-	}
+	ns := model.NetworkService{InstanceAddress: fc.instanceID}
 
-	// Update home- room- and devicelists
-	fc.states.DeviceCollection, fc.states.RoomCollection, fc.states.HomeCollection, fc.states.IndependentDeviceCollection = nil, nil, nil, nil
-	fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection = client.UpdateLists(fc.configs.Auth.AccessToken, fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection)
-	fc.states.SaveToFile()
+	// Lifecycle states are set where they change, at startup, login, logout, reset and token refresh.
+	// Only tokens are checked per message. Home, room and device lists are refreshed by the poll loop and by the
+	// commands that need fresh lists, so workers don't wait on each other for a full fetch from Mill.
+	fc.RefreshTokens()
 	log.Debug(" ")
 	log.Debug("New fimp msg")
-	addr := strings.Replace(newMsg.Addr.ServiceAddress, "_0", "", 1)
+	addr, ok := fc.deviceAddress(newMsg)
+	if !ok {
+		return
+	}
 	switch newMsg.Payload.Service {
 	case "thermostat":
 		log.Debug("Service: thermostat")
-		addr = strings.Replace(addr, "l", "", 1)
 		switch newMsg.Payload.Type {
 		case "cmd.setpoint.set":
-			fc.setpointSet(newMsg, config)
-
-		// case "cmd.setpoint.get_report":
-		// 	// You can ONLY get setpoint_report from devices that are independent(!). All devices have "holiday_temp" attribute, which for some reason is set temp on independent devices.
-		// 	// Will always be 0 if it is not an independent device.
-		// 	deviceIndex, err := fc.states.FindDeviceFromDeviceID(addr)
-		// 	if err != nil {
-		// 		log.Error(fmt.Errorf("Can't find device from deviceID, error: ", err))
-		// 	}
-		// 	device := reflect.ValueOf(fc.states.DeviceCollection[deviceIndex])
-		// 	setpointTemp := strconv.FormatInt(device.FieldByName("SetpointTemp").Interface().(int64), 10)
-
-		// 	if setpointTemp != "0" {
-		// 		val := map[string]interface{}{
-		// 			"type": "heat",
-		// 			"temp": setpointTemp,
-		// 			"unit": "C",
-		// 		}
-		// 		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "thermostat", ServiceAddress: addr}
-		// 		msg := fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, val, nil, nil, newMsg.Payload)
-		// 		fc.mqt.Publish(adr, msg)
-		// 	}
-
-		// case "cmd.mode.set":
-		// 	val, _ := newMsg.Payload.GetStringValue()
-		// 	log.Debug("Trying to set new mode: ", val)
-
-		// 	deviceIndex, err := fc.states.FindDeviceFromDeviceID(addr)
-		// 	if err != nil {
-		// 		log.Error(fmt.Errorf("Can't find device from deviceID, error: ", err))
-		// 	}
-		// 	device := reflect.ValueOf(fc.states.DeviceCollection[deviceIndex])
-		// 	currentSetTemp := device.FieldByName("SetpointTemp").Interface().(int64)
-		// 	log.Debug("setpointTemp: ", currentSetTemp)
-
-		// 	if config.ModeControl(fc.configs.Auth.AccessToken, addr, currentSetTemp, val) {
-		// 		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "thermostat", ServiceAddress: addr}
-		// 		msg := fimpgo.NewMessage("evt.mode.report", "thermostat", fimpgo.VTypeString, val, nil, nil, newMsg.Payload)
-		// 		fc.mqt.Publish(adr, msg)
-		// 		log.Info("Mode updated, new mode: ", val)
-		// 	} else {
-		// 		log.Error("Something went wrong when changing mode")
-		// 	}
+			fc.setpointSet(newMsg, addr)
+
+		case "cmd.setpoint.get_report":
+			fc.setpointReport(newMsg, addr)
+
+		case "cmd.mode.set":
+			fc.modeSet(newMsg, addr)
+
 		// Do we need this? Will/should allways be heat
 
 		case "cmd.mode.get_report":
 			val := "heat"
 
-			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "thermostat", ServiceAddress: addr}
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID, ServiceName: "thermostat", ServiceAddress: addr}
 			msg := fimpgo.NewMessage("evt.mode.report", "thermostat", fimpgo.VTypeString, val, nil, nil, newMsg.Payload)
 			fc.mqt.Publish(adr, msg)
 		}
 
 	case "sensor_temp":
 		log.Debug("Service: sensor_temp")
-		addr = strings.Replace(addr, "l", "", 1)
 		switch newMsg.Payload.Type {
 		case "cmd.sensor.get_report":
-			deviceIndex, err := fc.states.FindDeviceFromDeviceID(addr)
-			if err != nil {
-				// handle err
-				log.Error(fmt.Errorf("Can't find device from deviceID, error: ", err))
+			found, ok := fc.states.DeviceByID(addr)
+			if !ok {
+				fc.replyError(newMsg, fmt.Errorf("%w: %s", model.ErrDeviceNotFound, addr))
+				return
 			}
-			device := reflect.ValueOf(fc.states.DeviceCollection[deviceIndex])
-			currentTemp := device.FieldByName("CurrentTemp").Interface().(float32)
+			device := reflect.ValueOf(found)
+			currentTemp := device.FieldByName("AmbientTemp").Interface().(float64)
 
 			val := currentTemp
 			props := fimpgo.Props{}
 			props["unit"] = "C"
 
-			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_temp", ServiceAddress: addr}
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID, ServiceName: "sensor_temp", ServiceAddress: addr}
 			msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, val, props, nil, newMsg.Payload)
 			fc.mqt.Publish(adr, msg)
 		}
 
-	case model.ServiceName:
-
-		log.Debug("New payload type ", newMsg.Payload.Type)
-		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: "1"}
+	case "out_bin_switch":
+		log.Debug("Service: out_bin_switch")
 		switch newMsg.Payload.Type {
+		case "cmd.binary.set":
+			fc.binarySet(newMsg, addr)
 
-		case "cmd.auth.login":
-			newadr, msg, err := fc.configs.GetHubToken(newMsg)
-			if err != nil {
-				log.Error("Something went wrong when getting hub token")
-			} else {
-				fc.mqt.Publish(newadr, msg)
-			}
+		case "cmd.binary.get_report":
+			fc.binaryReport(newMsg, addr)
+		}
 
-			fc.configs.UID = newMsg.Payload.UID
+	case "meter_elec":
+		log.Debug("Service: meter_elec")
+		switch newMsg.Payload.Type {
+		case "cmd.meter.get_report":
+			fc.meterReport(newMsg, addr)
+		}
 
-		case "cmd.auth.set_tokens":
-			if fc.configs.Auth.AuthorizationCode != "" {
-				fc.configs.Auth.AccessToken, fc.configs.Auth.RefreshToken, fc.configs.Auth.ExpireTime, fc.configs.Auth.RefreshExpireTime = config.NewClient(fc.configs.Auth.AuthorizationCode, fc.configs.Password, fc.configs.Username)
-				fc.configs.Username = ""
-				fc.configs.Password = ""
-				fc.configs.SaveToFile()
-				fc.states.SaveToFile()
-			} else {
+	case "sensor_humid":
+		log.Debug("Service: sensor_humid")
+		switch newMsg.Payload.Type {
+		case "cmd.sensor.get_report":
+			found, ok := fc.states.DeviceByID(addr)
+			if !ok {
+				fc.replyError(newMsg, fmt.Errorf("%w: %s", model.ErrDeviceNotFound, addr))
+				return
 			}
+			device := reflect.ValueOf(found)
+			val := float64(device.FieldByName("Humidity").Interface().(int))
+			props := fimpgo.Props{}
+			props["unit"] = "%"
 
-			if fc.configs.Auth.AccessToken != "" {
-				fc.appLifecycle.SetAuthState(model.AuthStateAuthenticated)
-				log.Debug("All tokens received and saved.")
-				loginval := map[string]interface{}{
-					"errors":  nil,
-					"success": true,
-				}
-				newadr, err := fimpgo.NewAddressFromString("pt:j1/mt:rsp/rt:cloud/rn:remote-client/ad:smarthome-app")
-				if err != nil {
-					log.Debug("Could not make login response topic")
-				}
-				msg := fimpgo.NewMessage("evt.pd7.response", "vinculum", fimpgo.VTypeObject, loginval, nil, nil, newMsg.Payload)
-				msg.CorrelationID = fc.configs.UID
-				fc.mqt.Publish(newadr, msg)
-			} else {
-				fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
-				log.Info("Login failed, please try again")
-				loginval := map[string]interface{}{
-					"errors":  "Wrong username or password",
-					"success": false,
-				}
-				newadr, err := fimpgo.NewAddressFromString("pt:j1/mt:rsp/rt:cloud/rn:remote-client/ad:smarthome-app")
-				if err != nil {
-					log.Debug("Could not make login response topic")
-				}
-				msg := fimpgo.NewMessage("evt.pd7.response", "vinculum", fimpgo.VTypeObject, loginval, nil, nil, newMsg.Payload)
-				msg.CorrelationID = fc.configs.UID
-				fc.mqt.Publish(newadr, msg)
-			}
+			adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID, ServiceName: "sensor_humid", ServiceAddress: addr}
+			msg := fimpgo.NewMessage("evt.sensor.report", "sensor_humid", fimpgo.VTypeFloat, val, props, nil, newMsg.Payload)
+			fc.mqt.Publish(adr, msg)
+		}
 
-			msg := fimpgo.NewMessage("evt.auth.status_report", model.ServiceName, fimpgo.VTypeObject, fc.appLifecycle.GetAllStates(), nil, nil, newMsg.Payload)
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				// if response topic is not set , sending back to default application event topic
-				fc.mqt.Publish(adr, msg)
-			}
+	case model.ServiceName:
 
-			// Delete previously saved nodes, if there are any for some reason
-			fc.states.DeviceCollection, fc.states.RoomCollection, fc.states.HomeCollection, fc.states.IndependentDeviceCollection = nil, nil, nil, nil
-			fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection = client.UpdateLists(fc.configs.Auth.AccessToken, fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection)
+		log.Debug("New payload type ", newMsg.Payload.Type)
+		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID}
+		switch newMsg.Payload.Type {
 
-			msg = fimpgo.NewMessage("evt.network.get_all_nodes_report", model.ServiceName, fimpgo.VTypeObject, fc.states.DeviceCollection, nil, nil, newMsg.Payload)
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				// if response topic is not set , sending back to default application event topic
-				fc.mqt.Publish(adr, msg)
+		case "cmd.auth.login":
+			fc.finishRelogin()
+			fc.configs.SetUID(newMsg.Payload.UID)
+			if ok, err := fc.configs.SetLogin(newMsg); err != nil || !ok {
+				fc.replyError(newMsg, invalidPayload(errors.New("username or password is missing")))
+			} else if err = fc.requestAuthCode(model.PrimaryAccountID, newMsg.Payload); err != nil {
+				fc.replyError(newMsg, fmt.Errorf("can't get hub token: %w", err))
 			}
 
-			for i := 0; i < len(fc.states.DeviceCollection); i++ {
-				inclReport := ns.SendInclusionReport(i, fc.states.DeviceCollection)
-
-				msg := fimpgo.NewMessage("evt.thing.inclusion_report", "mill", fimpgo.VTypeObject, inclReport, nil, nil, nil)
-				adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: "1"}
-				fc.mqt.Publish(&adr, msg)
+		case "cmd.auth.set_tokens":
+			if accountID, _ := newMsg.Payload.GetStringValue(); accountID != "" {
+				fc.accountLogin(accountID, newMsg.Payload)
+				return
 			}
-			fc.configs.SaveToFile()
-			fc.states.SaveToFile()
+			fc.finishLogin(fc.login(), newMsg.Payload)
 
 		case "cmd.auth.logout":
-			fc.configs.Auth.AccessToken = ""
-			fc.appLifecycle.SetConfigState(model.ConfigStateNotConfigured)
-			fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
-			fc.appLifecycle.SetConnectionState(model.ConnStateDisconnected)
-			for i := 0; i < len(fc.states.DeviceCollection); i++ {
-				device := reflect.ValueOf(fc.states.DeviceCollection[i])
-				deviceID := strconv.FormatInt(device.FieldByName("DeviceID").Interface().(int64), 10)
-				val := map[string]interface{}{
-					"address": deviceID,
-				}
-				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: "1"}
-				msg := fimpgo.NewMessage("evt.thing.exclusion_report", "mill", fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-				fc.mqt.Publish(adr, msg)
-			}
-
-			fc.states.DeviceCollection, fc.states.RoomCollection, fc.states.HomeCollection, fc.states.IndependentDeviceCollection = nil, nil, nil, nil
-			fc.configs.LoadDefaults()
-			fc.states.LoadDefaults()
+			fc.logout(newMsg.Payload)
 
 			val2 := map[string]interface{}{
 				"errors":  nil,
@@ -293,21 +216,39 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 			}
 			log.Info("Logged out and deleted all devices.")
 
+		case "cmd.auth.add_account":
+			if err := fc.addAccount(newMsg.Payload); err != nil {
+				fc.replyError(newMsg, err)
+			}
+
+		case "cmd.auth.remove_account":
+			accountID, err := newMsg.Payload.GetStringValue()
+			if err != nil {
+				fc.replyError(newMsg, invalidPayload(err))
+				return
+			}
+			if err = fc.removeAccount(accountID, newMsg.Payload); err != nil {
+				fc.replyError(newMsg, err)
+				return
+			}
+			fc.publishAccountsReport(newMsg.Payload)
+
+		case "cmd.auth.get_accounts":
+			fc.publishAccountsReport(newMsg.Payload)
+
 		case "cmd.network.get_all_nodes":
 			// This case saves all homes, rooms and devices, but only sends devices back to fimp.
-			fc.states.DeviceCollection, fc.states.RoomCollection, fc.states.HomeCollection, fc.states.IndependentDeviceCollection = nil, nil, nil, nil
-			fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection = client.UpdateLists(fc.configs.Auth.AccessToken, fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection)
-			report := []ListReportRecord{}
-			if len(fc.states.DeviceCollection) == 0 {
-				fmt.Errorf("There are no devices")
+			if !fc.configs.IsConfigured() {
+				fc.replyError(newMsg, errNotAuthenticated)
 				return
 			}
-			for i := 0; i < len(fc.states.DeviceCollection); i++ {
-				device := reflect.ValueOf(fc.states.DeviceCollection[i])
-				deviceID := strconv.FormatInt(device.FieldByName("DeviceID").Interface().(int64), 10)
-				name := device.FieldByName("DeviceName").Interface().(string)
-				rec := ListReportRecord{Address: deviceID, Alias: "Mill " + name, PowerSource: "ac", WakeupInterval: "-1"}
-				report = append(report, rec)
+			if err := fc.UpdateLists(); err != nil {
+				fc.replyError(newMsg, err)
+				return
+			}
+			report := fc.nodesReport()
+			if len(report) == 0 {
+				log.Info("There are no devices")
 			}
 
 			msg := fimpgo.NewMessage("evt.network.get_all_nodes_report", model.ServiceName, fimpgo.VTypeObject, report, nil, nil, newMsg.Payload)
@@ -319,33 +260,29 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 			fc.states.SaveToFile()
 
 		case "cmd.system.sync":
-
-			// only
-			fc.states.DeviceCollection, fc.states.RoomCollection, fc.states.HomeCollection, fc.states.IndependentDeviceCollection = nil, nil, nil, nil
-			fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection = client.UpdateLists(fc.configs.Auth.AccessToken, fc.states.HomeCollection, fc.states.RoomCollection, fc.states.DeviceCollection, fc.states.IndependentDeviceCollection)
-			log.Debug(fc.configs.Auth.AccessToken)
-
-			for i := 0; i < len(fc.states.DeviceCollection); i++ {
-				inclReport := ns.SendInclusionReport(i, fc.states.DeviceCollection)
-
-				msg := fimpgo.NewMessage("evt.thing.inclusion_report", "mill", fimpgo.VTypeObject, inclReport, nil, nil, newMsg.Payload)
-				adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: "1"}
-				fc.mqt.Publish(&adr, msg)
-			}
-
+			summary, err := fc.syncDevices(newMsg.Payload)
 			val2 := model.ButtonActionResponse{
 				Operation:       "cmd.system.sync",
 				OperationStatus: "ok",
 				Next:            "reload",
 				ErrorCode:       "",
 				ErrorText:       "",
+				Summary:         summary,
+			}
+			if err != nil {
+				log.Error("Sync failed. Error: ", err)
+				val2.OperationStatus = "error"
+				val2.ErrorCode = "SYNC_FAILED"
+				val2.ErrorText = "Can't get devices from Mill. Please try again later."
 			}
 
 			msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val2, nil, nil, newMsg.Payload)
 			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
 				log.Error("Could not respond to wanted request")
 			}
-			log.Info("All devices synced")
+
+		case "cmd.system.get_metrics":
+			fc.sendMetricsReport(newMsg)
 
 		case "cmd.system.set_poll_time":
 			log.Debug("pollTime case")
@@ -353,29 +290,44 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 		case "cmd.app.get_manifest":
 			mode, err := newMsg.Payload.GetStringValue()
 			if err != nil {
-				log.Error("Incorrect request format ")
+				fc.replyError(newMsg, invalidPayload(err))
 				return
 			}
 			manifest := model.NewManifest()
 			err = manifest.LoadFromFile(filepath.Join(fc.configs.GetDefaultDir(), "app-manifest.json"))
 			if err != nil {
-				log.Error("Failed to load manifest file .Error :", err.Error())
+				fc.replyError(newMsg, fmt.Errorf("can't load manifest: %w", err))
 				return
 			}
 			if mode == "manifest_state" {
 				manifest.AppState = *fc.appLifecycle.GetAllStates()
-				fc.configs.ConnectionState = string(fc.appLifecycle.ConnectionState())
-				fc.configs.Errors = fc.appLifecycle.LastError()
+				errText := fc.appLifecycle.LastError()
+				if fc.isReauthRequired() {
+					errText = reauthRequiredText
+				}
+				fc.configs.SetStatus(string(fc.appLifecycle.ConnectionState()), errText)
 				manifest.ConfigState = fc.configs
 			}
 			if errConf := manifest.GetAppConfig("errors"); errConf != nil {
-				if fc.configs.Errors == "" {
+				if fc.configs.GetErrors() == "" {
 					errConf.Hidden = true
 				} else {
 					errConf.Hidden = false
 				}
 			}
 
+			for i := range manifest.Services {
+				manifest.Services[i].Address = fmt.Sprintf("/rt:ad/rn:%s/ad:%s", model.ServiceName, fc.instanceID)
+			}
+			fc.updateIgnoredDevicesBlock(manifest)
+			fc.updateHomesConfig(manifest)
+			millKeyHidden := fc.configs.GetAuthProvider() != model.AuthProviderMillKey
+			for _, id := range []string{"mill_access_key", "mill_secret_token"} {
+				if conf := manifest.GetAppConfig(id); conf != nil {
+					conf.Hidden = millKeyHidden
+				}
+			}
+
 			connectButton := manifest.GetButton("connect")
 			disconnectButton := manifest.GetButton("disconnect")
 			if connectButton != nil && disconnectButton != nil {
@@ -423,29 +375,29 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 			}
 
 		case "cmd.config.extended_set":
-			conf := model.Configs{}
-			err := newMsg.Payload.GetObjectValue(&conf)
-			if err != nil {
-				// TODO: This is an example . Add your logic here or remove
-				log.Error("Can't parse configuration object")
+			req := extendedSetRequest{}
+			if err := newMsg.Payload.GetObjectValue(&req); err != nil {
+				fc.replyError(newMsg, invalidPayload(err))
 				return
 			}
-			pollTimeMin := conf.PollTimeMin
-			_, err = strconv.Atoi(pollTimeMin)
-
-			if err != nil {
-				log.Error(fmt.Sprintf("%q is not a number or contains illegal symbols.", pollTimeMin))
-			} else {
-				fc.configs.PollTimeMin = pollTimeMin
-				fc.configs.SaveToFile()
-				log.Info("App reconfigured, new configs: ", fc.configs)
-				// TODO: This is an example . Add your logic here or remove
+			homesChanged, confErr := fc.applyExtendedSet(req, newMsg.Payload)
+			fc.configs.SaveToFile()
+			if homesChanged && fc.configs.IsConfigured() {
+				// Include devices in newly selected homes and exclude those in homes no longer selected.
+				if _, err := fc.syncDevices(newMsg.Payload); err != nil {
+					log.Error("Can't sync devices after changing homes. Error: ", err)
+				}
 			}
 
 			configReport := model.ConfigReport{
 				OpStatus: "ok",
 				AppState: *fc.appLifecycle.GetAllStates(),
 			}
+			if confErr != nil {
+				configReport.OpStatus = "error"
+				configReport.ErrorCode = errorCode(confErr)
+				configReport.ErrorText = confErr.Error()
+			}
 			msg := fimpgo.NewMessage("evt.app.config_report", model.ServiceName, fimpgo.VTypeObject, configReport, nil, nil, newMsg.Payload)
 			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
 				fc.mqt.Publish(adr, msg)
@@ -455,15 +407,18 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 			// Configure log level
 			level, err := newMsg.Payload.GetStringValue()
 			if err != nil {
+				fc.replyError(newMsg, invalidPayload(err))
 				return
 			}
 			logLevel, err := log.ParseLevel(level)
-			if err == nil {
-				log.SetLevel(logLevel)
-				fc.configs.LogLevel = level
-				fc.configs.SaveToFile()
-				fc.states.SaveToFile()
+			if err != nil {
+				fc.replyError(newMsg, invalidPayload(err))
+				return
 			}
+			log.SetLevel(logLevel)
+			fc.configs.SetLogLevel(level)
+			fc.configs.SaveToFile()
+			fc.states.SaveToFile()
 			log.Info("Log level updated to = ", logLevel)
 
 		case "cmd.system.reconnect":
@@ -483,83 +438,144 @@ func (fc *FromFimpRouter) routeFimpMessage(newMsg *fimpgo.Message) {
 			}
 
 		case "cmd.app.factory_reset":
-			val := model.ButtonActionResponse{
-				Operation:       "cmd.app.factory_reset",
-				OperationStatus: "ok",
-				Next:            "config",
-				ErrorCode:       "",
-				ErrorText:       "",
-			}
-			fc.appLifecycle.SetConfigState(model.ConfigStateNotConfigured)
-			fc.appLifecycle.SetAppState(model.AppStateNotConfigured, nil)
-			fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
-			msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-			if err := fc.mqt.RespondToRequest(newMsg.Payload, msg); err != nil {
-				fc.mqt.Publish(adr, msg)
+			err := fc.factoryReset(newMsg.Payload)
+			if err != nil {
+				log.Error("Factory reset failed. Error: ", err)
 			}
+			fc.sendActionReport("cmd.app.factory_reset", "ok", "config", err, newMsg.Payload)
 
 		case "cmd.thing.get_inclusion_report":
-			deviceID, err := newMsg.Payload.GetStringValue()
+			addr, err := newMsg.Payload.GetStringValue()
 			if err != nil {
-				// handle err
-				log.Error(fmt.Errorf("Can't get strValue, error: ", err))
+				fc.replyError(newMsg, invalidPayload(err))
+				return
 			}
-			nodeID, err := fc.states.FindDeviceFromDeviceID(deviceID)
-			if err != nil { // normal error handling did not work for some reason, find out why
-				// handle error
-				log.Error("error") // this never executes
+			deviceID, err := fc.knownDeviceAddress(addr)
+			if err != nil {
+				fc.replyError(newMsg, err)
+				return
 			}
-			if nodeID != 9999 { // using this method instead
-				inclReport := ns.SendInclusionReport(nodeID, fc.states.DeviceCollection)
-
-				msg := fimpgo.NewMessage("evt.thing.inclusion_report", "mill", fimpgo.VTypeObject, inclReport, nil, nil, nil)
-				adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: "1"}
-				fc.mqt.Publish(&adr, msg)
+			device, ok := fc.states.DeviceByID(deviceID)
+			if !ok {
+				fc.replyError(newMsg, fmt.Errorf("%w: %s", model.ErrDeviceNotFound, deviceID))
+				return
 			}
+			inclReport := ns.SendInclusionReport(device)
+
+			msg := fimpgo.NewMessage("evt.thing.inclusion_report", "mill", fimpgo.VTypeObject, inclReport, nil, nil, nil)
+			adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: fc.instanceID}
+			fc.mqt.Publish(&adr, msg)
 
 		case "cmd.thing.inclusion":
-			//flag , _ := newMsg.Payload.GetBoolValue()
-			// TODO: This is an example . Add your logic here or remove
+			start, err := newMsg.Payload.GetBoolValue()
+			if err != nil {
+				fc.replyError(newMsg, invalidPayload(err))
+				return
+			}
+			if start && !fc.configs.IsConfigured() {
+				fc.replyError(newMsg, errNotAuthenticated)
+				return
+			}
+			if start {
+				fc.startInclusion(newMsg.Payload)
+			} else {
+				fc.stopInclusion()
+			}
 		case "cmd.thing.delete":
 			// remove device from network
 			val, err := newMsg.Payload.GetStrMapValue()
 			if err != nil {
-				log.Error("Wrong msg format")
+				fc.replyError(newMsg, invalidPayload(err))
 				return
 			}
-			deviceID := val["address"]
-			deviceExists, err := fc.states.FindDeviceFromDeviceID(deviceID)
-			if deviceExists != 9999 {
-				val := map[string]interface{}{
-					"address": deviceID,
-				}
-				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: "1"}
-				msg := fimpgo.NewMessage("evt.thing.exclusion_report", "mill", fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-				fc.mqt.Publish(adr, msg)
-				log.Info("Device with deviceID: ", deviceID, " has been removed from network.")
+			deviceID, err := fc.knownDeviceAddress(val["address"])
+			if err != nil {
+				fc.replyError(newMsg, err)
+				return
+			}
+			fc.ignoreDevice(deviceID, newMsg.Payload)
+			log.Info("Device with deviceID: ", deviceID, " has been removed from network.")
+
+		case "cmd.thing.restore":
+			deviceID, err := newMsg.Payload.GetStringValue()
+			if err != nil {
+				fc.replyError(newMsg, invalidPayload(err))
+				return
+			}
+			if err = fc.restoreDevice(deviceID, newMsg.Payload); err != nil {
+				fc.replyError(newMsg, err)
 			}
 
 		case "cmd.app.uninstall":
-			for i := 0; i < len(fc.states.DeviceCollection); i++ {
-				device := reflect.ValueOf(fc.states.DeviceCollection[i])
-				deviceID := strconv.FormatInt(device.FieldByName("DeviceID").Interface().(int64), 10)
-				val := map[string]interface{}{
-					"address": deviceID,
-				}
-				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: "1"}
-				msg := fimpgo.NewMessage("evt.thing.exclusion_report", "mill", fimpgo.VTypeObject, val, nil, nil, newMsg.Payload)
-				fc.mqt.Publish(adr, msg)
+			err := fc.uninstall(newMsg.Payload)
+			if err != nil {
+				log.Error("Uninstall failed. Error: ", err)
 			}
+			fc.sendActionReport("cmd.app.uninstall", "ok", "", err, newMsg.Payload)
 		}
 
 	case "auth-api":
-		fc.configs.Auth.AuthorizationCode, fc.configs.HubToken = config.GetAuthCode(newMsg)
-
-		msg := fimpgo.NewMessage("cmd.auth.set_tokens", model.ServiceName, fimpgo.VTypeString, "", nil, nil, newMsg.Payload)
-		newadr, err := fimpgo.NewAddressFromString("pt:j1/mt:cmd/rt:ad/rn:mill/ad:1")
+		val, err := newMsg.Payload.GetStrMapValue()
 		if err != nil {
-			log.Debug(err)
+			log.Error("Wrong msg format")
+			return
+		}
+		accountID, requested := fc.takeAuthAccount(newMsg.Payload.CorrelationID)
+		if !requested {
+			log.Debug("Ignoring hub token, it was requested by another instance")
+			return
 		}
-		fc.mqt.Publish(newadr, msg)
+		fc.setAuthCode(fc.authCodeProvider(), val["token"], accountID, newMsg.Payload)
+	}
+}
+
+// nodesReport lists all devices, with the Mill home and room they are in, for evt.network.get_all_nodes_report.
+func (fc *FromFimpRouter) nodesReport() []ListReportRecord {
+	devices := fc.states.Devices()
+	report := []ListReportRecord{}
+	for i := 0; i < len(devices); i++ {
+		device := reflect.ValueOf(devices[i])
+		deviceID := model.DeviceAddressOf(devices[i])
+		name := device.FieldByName("DeviceName").Interface().(string)
+		location := model.DeviceLocation(devices[i])
+		rec := ListReportRecord{Address: deviceID, Alias: "Mill " + name, PowerSource: "ac", WakeupInterval: "-1", Home: location["home"], Room: location["room"], Independent: location["independent"] == "true"}
+		report = append(report, rec)
+	}
+	return report
+}
+
+// deviceAddress decodes the service address of a command to a device service. Messages to the adapter itself have
+// no device address. Commands to malformed addresses or devices not in the device list, and commands sent before
+// logging in, are answered with an error report.
+// Events are skipped, the adapter receives its own reports on the device topics.
+func (fc *FromFimpRouter) deviceAddress(newMsg *fimpgo.Message) (string, bool) {
+	if newMsg.Addr.ResourceType != fimpgo.ResourceTypeDevice {
+		return "", true
+	}
+	if newMsg.Addr.MsgType != fimpgo.MsgTypeCmd {
+		return "", false
+	}
+	if !fc.configs.IsConfigured() {
+		fc.replyError(newMsg, errNotAuthenticated)
+		return "", false
+	}
+	addr, err := fc.knownDeviceAddress(newMsg.Addr.ServiceAddress)
+	if err != nil {
+		fc.replyError(newMsg, err)
+		return "", false
+	}
+	return addr, true
+}
+
+// knownDeviceAddress decodes a device address and checks that the device is in the device list.
+func (fc *FromFimpRouter) knownDeviceAddress(serviceAddress string) (string, error) {
+	devAddr, err := model.ParseDeviceAddress(serviceAddress)
+	if err != nil {
+		return "", fmt.Errorf("%w %q", err, serviceAddress)
+	}
+	addr := devAddr.String()
+	if _, ok := fc.states.DeviceByID(addr); !ok {
+		return "", fmt.Errorf("%w: %s", model.ErrDeviceNotFound, addr)
 	}
+	return addr, nil
 }
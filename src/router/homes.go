@@ -0,0 +1,56 @@
+package router
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/futurehomeno/edge-mill-adapter/model"
+)
+
+// updateHomesConfig lists the homes on the Mill account in the manifest, so the user can choose which to use.
+// The config is hidden until the homes have been fetched.
+func (fc *FromFimpRouter) updateHomesConfig(manifest *model.Manifest) {
+	options := []map[string]interface{}{}
+	for _, home := range fc.states.Homes() {
+		id, name, ok := homeInfo(home)
+		if !ok {
+			continue
+		}
+		options = append(options, map[string]interface{}{
+			"val":   id,
+			"label": model.MultilingualLabel{"en": fmt.Sprintf("%s (%s)", name, id)},
+		})
+	}
+	if conf := manifest.GetAppConfig("selected_homes"); conf != nil {
+		conf.UI.Select = options
+		conf.Hidden = len(options) == 0
+	}
+}
+
+// homeInfo returns id and name of a home from the home list.
+func homeInfo(home interface{}) (id string, name string, ok bool) {
+	val := reflect.ValueOf(home)
+	if val.Kind() != reflect.Struct {
+		return "", "", false
+	}
+	return strconv.FormatInt(val.FieldByName("HomeID").Int(), 10), val.FieldByName("HomeName").String(), true
+}
+
+// sameStrings is true if a and b have the same values, in any order.
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package router
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// ignoreDevice excludes a device deleted by the user and keeps it out of sync and polling until it is restored.
+func (fc *FromFimpRouter) ignoreDevice(addr string, reqPayload *fimpgo.FimpMessage) {
+	name := addr
+	if device, ok := fc.states.DeviceByID(addr); ok {
+		name = reflect.ValueOf(device).FieldByName("DeviceName").Interface().(string)
+	}
+	fc.publishExclusionReport(addr, reqPayload)
+	fc.states.IgnoreDevice(addr, name)
+	fc.states.ForgetKnownDevice(addr)
+	fc.states.SaveToFile()
+}
+
+// restoreDevice includes an ignored device again.
+func (fc *FromFimpRouter) restoreDevice(addr string, reqPayload *fimpgo.FimpMessage) error {
+	if !fc.states.RestoreDevice(addr) {
+		return fmt.Errorf("device %s is not ignored", addr)
+	}
+	if device, ok := fc.states.DeviceByID(addr); ok {
+		ns := model.NetworkService{InstanceAddress: fc.instanceID}
+		inclReport := ns.SendInclusionReport(device)
+		fc.publishInclusionReport(inclReport, reqPayload)
+		fc.states.SetKnownDevice(addr, model.KnownDevice{Name: inclReport.Alias, Fingerprint: reportFingerprint(inclReport)})
+	} else {
+		log.Infof("<router> Device %s isn't on the Mill account anymore, it is included on next sync if it comes back", addr)
+	}
+	log.Info("<router> Restored device ", addr)
+	return fc.states.SaveToFile()
+}
+
+// updateIgnoredDevicesBlock lists ignored devices in the manifest, so they can be restored one at a time.
+// The block is hidden when no devices are ignored.
+func (fc *FromFimpRouter) updateIgnoredDevicesBlock(manifest *model.Manifest) {
+	ignored := fc.states.GetIgnoredDevices()
+	addrs := make([]string, 0, len(ignored))
+	for addr := range ignored {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	options := []map[string]interface{}{}
+	for _, addr := range addrs {
+		options = append(options, map[string]interface{}{
+			"val":   addr,
+			"label": model.MultilingualLabel{"en": fmt.Sprintf("Mill %s (%s)", ignored[addr], addr)},
+		})
+	}
+	if conf := manifest.GetAppConfig("restore_device"); conf != nil {
+		conf.UI.Select = options
+		conf.Hidden = len(options) == 0
+	}
+	if block := manifest.GetUIBlock("ignored_devices"); block != nil {
+		block.Hidden = len(options) == 0
+	}
+}
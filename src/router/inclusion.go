@@ -0,0 +1,123 @@
+package router
+
+import (
+	"time"
+
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// inclusionTimeout is how long inclusion mode waits for new devices on the Mill account.
+	inclusionTimeout = 2 * time.Minute
+	// inclusionPollInterval is how often Mill is asked for devices while inclusion mode is on.
+	inclusionPollInterval = 10 * time.Second
+
+	InclusionStarted = "ADD_NODE_STARTED"
+	InclusionDone    = "ADD_NODE_DONE"
+	InclusionStopped = "ADD_NODE_STOPPED"
+	InclusionFailed  = "ADD_NODE_FAILED"
+)
+
+// startInclusion turns on inclusion mode. Devices added to the Mill account while it is on, and not yet known
+// to the hub, are included. Inclusion mode stops after the first new devices, on timeout or by stopInclusion.
+func (fc *FromFimpRouter) startInclusion(reqPayload *fimpgo.FimpMessage) {
+	fc.inclusionMux.Lock()
+	defer fc.inclusionMux.Unlock()
+	if fc.inclusionStop != nil {
+		log.Debug("<router> Inclusion is already running")
+		return
+	}
+	stop := make(chan struct{})
+	fc.inclusionStop = stop
+	log.Info("<router> Inclusion started")
+	fc.publishInclusionStatus(InclusionStarted, reqPayload)
+	go fc.runInclusion(stop, reqPayload)
+}
+
+// stopInclusion turns off inclusion mode if it is on.
+func (fc *FromFimpRouter) stopInclusion() {
+	fc.inclusionMux.Lock()
+	defer fc.inclusionMux.Unlock()
+	if fc.inclusionStop != nil {
+		close(fc.inclusionStop)
+		fc.inclusionStop = nil
+	}
+}
+
+func (fc *FromFimpRouter) runInclusion(stop chan struct{}, reqPayload *fimpgo.FimpMessage) {
+	timeout := time.NewTimer(inclusionTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(inclusionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		added, err := fc.includeNewDevices(reqPayload)
+		if err != nil {
+			log.Error("<router> Inclusion failed. Error: ", err)
+			fc.finishInclusion(stop, InclusionFailed, reqPayload)
+			return
+		}
+		if len(added) > 0 {
+			log.Info("<router> Inclusion done, added: ", added)
+			fc.finishInclusion(stop, InclusionDone, reqPayload)
+			return
+		}
+		select {
+		case <-stop:
+			log.Info("<router> Inclusion stopped")
+			fc.publishInclusionStatus(InclusionStopped, reqPayload)
+			return
+		case <-timeout.C:
+			log.Info("<router> Inclusion timed out, no new devices found")
+			fc.finishInclusion(stop, InclusionStopped, reqPayload)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// finishInclusion ends inclusion mode started with stop, unless it has been stopped already.
+func (fc *FromFimpRouter) finishInclusion(stop chan struct{}, status string, reqPayload *fimpgo.FimpMessage) {
+	fc.inclusionMux.Lock()
+	if fc.inclusionStop != stop {
+		fc.inclusionMux.Unlock()
+		return
+	}
+	fc.inclusionStop = nil
+	fc.inclusionMux.Unlock()
+	fc.publishInclusionStatus(status, reqPayload)
+}
+
+// includeNewDevices fetches devices from Mill and includes those that are neither known nor ignored. Known devices
+// are left alone, changes to them are handled by sync.
+func (fc *FromFimpRouter) includeNewDevices(reqPayload *fimpgo.FimpMessage) ([]string, error) {
+	added := []string{}
+	if err := fc.UpdateLists(); err != nil {
+		return added, err
+	}
+	ns := model.NetworkService{InstanceAddress: fc.instanceID}
+	known := fc.states.GetKnownDevices()
+	devices := fc.states.Devices()
+	for i := 0; i < len(devices); i++ {
+		inclReport := ns.SendInclusionReport(devices[i])
+		addr := inclReport.Address
+		if _, ok := known[addr]; ok || fc.states.IsIgnored(addr) {
+			continue
+		}
+		fc.publishInclusionReport(inclReport, reqPayload)
+		fc.states.SetKnownDevice(addr, model.KnownDevice{Name: inclReport.Alias, Fingerprint: reportFingerprint(inclReport)})
+		added = append(added, addr)
+	}
+	if len(added) == 0 {
+		return added, nil
+	}
+	return added, fc.states.SaveToFile()
+}
+
+func (fc *FromFimpRouter) publishInclusionStatus(status string, reqPayload *fimpgo.FimpMessage) {
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID}
+	msg := fimpgo.NewMessage("evt.thing.inclusion_status_report", model.ServiceName, fimpgo.VTypeString, status, nil, nil, reqPayload)
+	fc.mqt.Publish(adr, msg)
+}
@@ -0,0 +1,106 @@
+package router
+
+import (
+	"errors"
+	"time"
+
+	mill "github.com/futurehomeno/edge-mill-adapter/millapi"
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// RefreshTokens gets new tokens if expireTime is exceeded. expireTime lasts for two hours, refreshExpireTime lasts for 30 days.
+func (fc *FromFimpRouter) RefreshTokens() {
+	fc.refreshMux.Lock()
+	defer fc.refreshMux.Unlock()
+	// Runs before the unlock above.
+	defer fc.refreshAccounts()
+
+	auth := fc.configs.GetAuth()
+	if auth.ExpireTime == 0 {
+		return
+	}
+	log.Debug("Checking expireTime")
+	millis := time.Now().UnixNano() / 1000000
+	if millis > auth.ExpireTime && millis < auth.RefreshExpireTime {
+		log.Debug("Trying to set new tokens")
+		config := mill.Config{}
+		accessToken, refreshToken, expireTime, refreshExpireTime, err := config.RefreshToken(auth.RefreshToken)
+		if errors.Is(err, mill.ErrInvalidCredentials) {
+			// Mill rejected the refresh token before its expiry time, so it is marked as expired.
+			log.Error("<router> Mill rejected the refresh token. Error: ", err)
+			auth.RefreshExpireTime = 0
+			fc.configs.SetAuth(auth)
+			fc.configs.SaveToFile()
+			fc.handleRefreshExpired()
+			return
+		}
+		if err == nil {
+			auth.AccessToken = accessToken
+			auth.RefreshToken = refreshToken
+			auth.ExpireTime = expireTime
+			auth.RefreshExpireTime = refreshExpireTime
+			fc.appLifecycle.SetConnectionState(model.ConnStateConnected)
+		} else {
+			log.Debug(err)
+			auth.ExpireTime = 1
+			fc.appLifecycle.SetConnectionState(model.ConnStateDisconnected)
+		}
+		fc.configs.SetAuth(auth)
+		fc.configs.SaveToFile()
+	} else if millis > auth.RefreshExpireTime {
+		fc.handleRefreshExpired()
+	} else {
+		log.Debug("expiretime is OK")
+	}
+}
+
+// UpdateLists fetches homes, rooms and devices from Mill and saves them in states. The saved lists are kept if
+// fetching fails, so devices don't disappear because of a network error. Extra accounts are fetched one by one,
+// and an account that fails keeps its saved devices without affecting the others.
+func (fc *FromFimpRouter) UpdateLists() error {
+	fc.listsMux.Lock()
+	defer fc.listsMux.Unlock()
+
+	client := mill.Client{}
+	homes, rooms, devices, independentDevices, err := client.UpdateLists(fc.configs.GetAccessToken(), nil, nil, nil, nil, fc.configs.IsHomeSelected)
+	if err != nil {
+		return err
+	}
+	for _, account := range fc.configs.GetAccounts() {
+		// Saved devices of accounts that can't be fetched are kept, so sync doesn't exclude them.
+		var err error
+		var accHomes, accRooms, accDevices, accIndependentDevices []interface{}
+		if account.Auth.AccessToken == "" {
+			err = errNotAuthenticated
+		} else {
+			client := mill.Client{}
+			accHomes, accRooms, accDevices, accIndependentDevices, err = client.UpdateLists(account.Auth.AccessToken, nil, nil, nil, nil, fc.configs.IsHomeSelected)
+		}
+		if err != nil {
+			log.Errorf("<router> Can't update lists of account %s. Error: %v", account.Name, err)
+			devices = append(devices, accountDevices(fc.states.Devices(), account.ID)...)
+			independentDevices = append(independentDevices, accountDevices(fc.states.IndependentDevices(), account.ID)...)
+			continue
+		}
+		homes = append(homes, accHomes...)
+		rooms = append(rooms, accRooms...)
+		devices = append(devices, withAccount(accDevices, account.ID)...)
+		independentDevices = append(independentDevices, withAccount(accIndependentDevices, account.ID)...)
+	}
+	fc.states.SetCollections(homes, rooms, devices, independentDevices)
+	return fc.states.SaveToFile()
+}
+
+// withAccount marks devices as belonging to an extra account, which namespaces their addresses.
+func withAccount(devices []interface{}, accountID string) []interface{} {
+	marked := make([]interface{}, 0, len(devices))
+	for _, device := range devices {
+		if d, ok := device.(mill.Device); ok {
+			d.AccountID = accountID
+			device = d
+		}
+		marked = append(marked, device)
+	}
+	return marked
+}
@@ -0,0 +1,103 @@
+package router
+
+import (
+	"time"
+
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// reloginRetryInterval limits how often a failed automatic re-login is retried.
+	reloginRetryInterval = time.Hour
+
+	reauthRequiredText = "Mill login has expired. Please log in again."
+)
+
+// reloginState tracks automatic re-login and whether the user has been told to log in again.
+type reloginState struct {
+	inProgress   bool
+	lastAttempt  time.Time
+	reauthNotify bool
+}
+
+// handleRefreshExpired is called when the 30 day refresh token has expired. The login flow is run again if auto
+// re-login is enabled, otherwise the user is asked to log in again.
+func (fc *FromFimpRouter) handleRefreshExpired() {
+	if fc.configs.GetAutoRelogin() {
+		if username, password := fc.configs.GetCredentials(); username != "" && password != "" {
+			fc.startRelogin()
+			return
+		}
+		log.Warn("<router> Auto re-login is enabled, but there are no stored credentials")
+	}
+	fc.requireReauth()
+}
+
+// startRelogin runs the same authorization code and NewClient flow as a manual login.
+func (fc *FromFimpRouter) startRelogin() {
+	fc.reloginMux.Lock()
+	if time.Since(fc.relogin.lastAttempt) < reloginRetryInterval {
+		fc.reloginMux.Unlock()
+		return
+	}
+	fc.relogin.inProgress = true
+	fc.relogin.lastAttempt = time.Now()
+	fc.reloginMux.Unlock()
+
+	log.Info("<router> Refresh token has expired, logging in to Mill again")
+	fc.appLifecycle.SetAuthState(model.AuthStateInProgress)
+	if err := fc.requestAuthCode(model.PrimaryAccountID, nil); err != nil {
+		fc.finishRelogin()
+		fc.requireReauth()
+	}
+}
+
+// finishRelogin returns true if the ongoing login was started by startRelogin.
+func (fc *FromFimpRouter) finishRelogin() bool {
+	fc.reloginMux.Lock()
+	defer fc.reloginMux.Unlock()
+	wasRelogin := fc.relogin.inProgress
+	fc.relogin.inProgress = false
+	return wasRelogin
+}
+
+// requireReauth sets auth state to REAUTH_REQUIRED, shows an error in the manifest and notifies the user once.
+func (fc *FromFimpRouter) requireReauth() {
+	fc.appLifecycle.SetAuthState(model.AuthStateReauthRequired)
+	fc.appLifecycle.SetConnectionState(model.ConnStateDisconnected)
+	fc.configs.SetStatus(model.ConnStateDisconnected, reauthRequiredText)
+
+	fc.reloginMux.Lock()
+	notified := fc.relogin.reauthNotify
+	fc.relogin.reauthNotify = true
+	fc.reloginMux.Unlock()
+	if notified {
+		return
+	}
+	log.Error("<router> 30 day refresh token has expired. Log in again with cmd.auth.login")
+	val := map[string]string{
+		"auth_state": model.AuthStateReauthRequired,
+		"text":       reauthRequiredText,
+	}
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID}
+	msg := fimpgo.NewMessage("evt.auth.reauth_required", model.ServiceName, fimpgo.VTypeStrMap, val, nil, nil, nil)
+	fc.mqt.Publish(adr, msg)
+}
+
+// clearReauth is called after a successful login.
+func (fc *FromFimpRouter) clearReauth() {
+	fc.reloginMux.Lock()
+	fc.relogin.reauthNotify = false
+	fc.relogin.lastAttempt = time.Time{}
+	fc.reloginMux.Unlock()
+	if fc.configs.GetErrors() == reauthRequiredText {
+		fc.configs.SetStatus(model.ConnStateConnected, "")
+	}
+}
+
+// isReauthRequired is true while the user has to log in again.
+func (fc *FromFimpRouter) isReauthRequired() bool {
+	return fc.appLifecycle.AuthState() == model.AuthStateReauthRequired
+}
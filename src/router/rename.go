@@ -0,0 +1,39 @@
+package router
+
+import (
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// PropagateRenames compares device names from the last poll with the names known by Futurehome. A device renamed
+// in the Mill app gets a new inclusion report with the new name, unless Futurehome names are kept. Either way the
+// new name is remembered, so the rename is only handled once.
+func (fc *FromFimpRouter) PropagateRenames() {
+	ns := model.NetworkService{InstanceAddress: fc.instanceID}
+	keepNames := fc.configs.GetKeepFuturehomeNames()
+	known := fc.states.GetKnownDevices()
+	renamed := false
+	devices := fc.states.Devices()
+	for i := 0; i < len(devices); i++ {
+		inclReport := ns.SendInclusionReport(devices[i])
+		addr := inclReport.Address
+		knownDevice, ok := known[addr]
+		if !ok || knownDevice.Name == inclReport.Alias || fc.states.IsIgnored(addr) {
+			continue
+		}
+		if keepNames {
+			log.Infof("<router> Device %s was renamed in Mill from %q to %q, keeping the Futurehome name", addr, knownDevice.Name, inclReport.Alias)
+		} else {
+			log.Infof("<router> Device %s was renamed in Mill from %q to %q", addr, knownDevice.Name, inclReport.Alias)
+			fc.publishInclusionReport(inclReport, nil)
+		}
+		fc.states.SetKnownDevice(addr, model.KnownDevice{Name: inclReport.Alias, Fingerprint: reportFingerprint(inclReport)})
+		renamed = true
+	}
+	if !renamed {
+		return
+	}
+	if err := fc.states.SaveToFile(); err != nil {
+		log.Error("<router> Can't save states after rename. Error: ", err)
+	}
+}
@@ -0,0 +1,73 @@
+package router
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// factoryReset logs out, restores config and state from defaults and starts the lifecycle over from NOT_CONFIGURED.
+func (fc *FromFimpRouter) factoryReset(reqPayload *fimpgo.FimpMessage) error {
+	log.Info("<router> Factory reset")
+	fc.logout(reqPayload)
+	if err := fc.configs.ResetToDefaults(); err != nil {
+		return err
+	}
+	if err := fc.states.ResetToDefaults(); err != nil {
+		return err
+	}
+	if logLevel, err := log.ParseLevel(fc.configs.GetLogLevel()); err == nil {
+		log.SetLevel(logLevel)
+	}
+	fc.appLifecycle.SetConfigState(model.ConfigStateNotConfigured)
+	fc.appLifecycle.SetAuthState(model.AuthStateNotAuthenticated)
+	fc.appLifecycle.SetConnectionState(model.ConnStateDisconnected)
+	fc.appLifecycle.SetAppState(model.AppStateNotConfigured, nil)
+	return nil
+}
+
+// uninstall excludes all devices, wipes credentials and deletes the data directory and log files. The app stays in
+// TERMINATING until it is stopped.
+func (fc *FromFimpRouter) uninstall(reqPayload *fimpgo.FimpMessage) error {
+	log.Info("<router> Uninstalling")
+	fc.sendActionReport("cmd.app.uninstall", "in_progress", "", nil, reqPayload)
+	fc.logout(reqPayload)
+	fc.appLifecycle.SetAppState(model.AppStateTerminate, nil)
+	if err := os.RemoveAll(fc.configs.GetDataDir()); err != nil {
+		return err
+	}
+	if logFile := fc.configs.GetLogFile(); logFile != "" {
+		// lumberjack keeps rotated logs next to the log file, named <name>-<timestamp><ext>.
+		ext := filepath.Ext(logFile)
+		backups, _ := filepath.Glob(strings.TrimSuffix(logFile, ext) + "-*" + ext)
+		for _, file := range append(backups, logFile) {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				log.Error("<router> Can't remove log file. Error: ", err)
+			}
+		}
+	}
+	return nil
+}
+
+// sendActionReport reports the status of a button action with evt.app.config_action_report.
+func (fc *FromFimpRouter) sendActionReport(operation string, status string, next string, err error, reqPayload *fimpgo.FimpMessage) {
+	val := model.ButtonActionResponse{
+		Operation:       operation,
+		OperationStatus: status,
+		Next:            next,
+	}
+	if err != nil {
+		val.OperationStatus = "error"
+		val.ErrorCode = errorCode(err)
+		val.ErrorText = err.Error()
+	}
+	msg := fimpgo.NewMessage("evt.app.config_action_report", model.ServiceName, fimpgo.VTypeObject, val, nil, nil, reqPayload)
+	if err := fc.mqt.RespondToRequest(reqPayload, msg); err != nil {
+		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID}
+		fc.mqt.Publish(adr, msg)
+	}
+}
@@ -0,0 +1,118 @@
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	"github.com/futurehomeno/fimpgo"
+	"github.com/futurehomeno/fimpgo/fimptype"
+	log "github.com/sirupsen/logrus"
+)
+
+// SyncSummary lists the addresses of devices added, removed and updated by a sync.
+type SyncSummary struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Updated []string `json:"updated"`
+}
+
+// syncDevices fetches devices from Mill and compares them with the known devices. New devices are included,
+// devices removed from the Mill account are excluded, and devices whose inclusion report changed, e.g. after a
+// rename, are reported again. Renames aren't reported if Futurehome names are kept, and other changes are then
+// reported with the known name. Nothing is excluded if fetching fails or there is no access token to fetch with.
+func (fc *FromFimpRouter) syncDevices(reqPayload *fimpgo.FimpMessage) (SyncSummary, error) {
+	summary := SyncSummary{Added: []string{}, Removed: []string{}, Updated: []string{}}
+	if fc.configs.GetAccessToken() == "" {
+		return summary, errNotAuthenticated
+	}
+	if err := fc.UpdateLists(); err != nil {
+		return summary, err
+	}
+	ns := model.NetworkService{InstanceAddress: fc.instanceID}
+	keepNames := fc.configs.GetKeepFuturehomeNames()
+	known := fc.states.GetKnownDevices()
+	ignored := fc.states.GetIgnoredDevices()
+	devices := fc.states.Devices()
+	for i := 0; i < len(devices); i++ {
+		inclReport := ns.SendInclusionReport(devices[i])
+		addr := inclReport.Address
+		if _, ok := ignored[addr]; ok {
+			delete(ignored, addr)
+			continue
+		}
+		millName := inclReport.Alias
+		fingerprint := reportFingerprint(inclReport)
+		knownDevice, isKnown := known[addr]
+		delete(known, addr)
+		renamed := isKnown && knownDevice.Name != millName
+		if isKnown && knownDevice.Fingerprint == fingerprint && (!renamed || keepNames) {
+			if renamed {
+				log.Infof("<router> Device %s was renamed in Mill from %q to %q, keeping the Futurehome name", addr, knownDevice.Name, millName)
+				fc.states.SetKnownDevice(addr, model.KnownDevice{Name: millName, Fingerprint: fingerprint})
+			}
+			continue
+		}
+		if isKnown {
+			summary.Updated = append(summary.Updated, addr)
+			if keepNames {
+				inclReport.Alias = knownDevice.Name
+			}
+		} else {
+			summary.Added = append(summary.Added, addr)
+		}
+		fc.publishInclusionReport(inclReport, reqPayload)
+		fc.states.SetKnownDevice(addr, model.KnownDevice{Name: millName, Fingerprint: fingerprint})
+	}
+	// Devices left in known are no longer on the Mill account.
+	for addr := range known {
+		summary.Removed = append(summary.Removed, addr)
+		fc.publishExclusionReport(addr, reqPayload)
+		fc.states.ForgetKnownDevice(addr)
+	}
+	// Devices left in ignored weren't fetched. Only when all homes are used does that mean they are no longer on the
+	// Mill account, otherwise they may be in a home that isn't selected and must stay ignored.
+	if len(fc.configs.GetSelectedHomes()) == 0 {
+		for addr := range ignored {
+			fc.states.RestoreDevice(addr)
+		}
+	}
+	log.Infof("<router> Synced devices, added: %v, removed: %v, updated: %v", summary.Added, summary.Removed, summary.Updated)
+	return summary, fc.states.SaveToFile()
+}
+
+// excludeAllDevices excludes all included devices and forgets them.
+func (fc *FromFimpRouter) excludeAllDevices(reqPayload *fimpgo.FimpMessage) {
+	for addr := range fc.states.GetKnownDevices() {
+		fc.publishExclusionReport(addr, reqPayload)
+	}
+	fc.states.ClearKnownDevices()
+}
+
+func (fc *FromFimpRouter) publishInclusionReport(inclReport interface{}, reqPayload *fimpgo.FimpMessage) {
+	msg := fimpgo.NewMessage("evt.thing.inclusion_report", "mill", fimpgo.VTypeObject, inclReport, nil, nil, reqPayload)
+	adr := fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: fc.instanceID}
+	fc.mqt.Publish(&adr, msg)
+}
+
+func (fc *FromFimpRouter) publishExclusionReport(addr string, reqPayload *fimpgo.FimpMessage) {
+	val := map[string]interface{}{
+		"address": addr,
+	}
+	adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: "mill", ResourceAddress: fc.instanceID}
+	msg := fimpgo.NewMessage("evt.thing.exclusion_report", "mill", fimpgo.VTypeObject, val, nil, nil, reqPayload)
+	fc.mqt.Publish(adr, msg)
+}
+
+// reportFingerprint is a hash of the inclusion report, so changes to services can be detected. The name is left out,
+// since renames are compared with the known name instead.
+func reportFingerprint(inclReport fimptype.ThingInclusionReport) string {
+	inclReport.Alias = ""
+	body, err := json.Marshal(inclReport)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,174 @@
+package router
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/futurehomeno/edge-mill-adapter/model"
+	"github.com/futurehomeno/fimpgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWorkerCount     = 4
+	defaultWorkerQueueSize = 20
+
+	// QueueFullPolicyBlock makes the dispatcher wait until the worker has room. MQTT delivery is delayed meanwhile.
+	QueueFullPolicyBlock = "block"
+	// QueueFullPolicyDropNewest drops the incoming message.
+	QueueFullPolicyDropNewest = "drop_newest"
+	// QueueFullPolicyDropOldest drops the oldest message waiting for the worker to make room for the incoming one.
+	QueueFullPolicyDropOldest = "drop_oldest"
+)
+
+// RouterMetrics describes load on the router workers.
+type RouterMetrics struct {
+	Workers         int     `json:"workers"`
+	QueueDepth      int     `json:"queue_depth"`
+	QueueDepths     []int   `json:"queue_depths"`
+	QueueCapacity   int     `json:"queue_capacity"`
+	QueueFullPolicy string  `json:"queue_full_policy"`
+	Received        uint64  `json:"received"`
+	Processed       uint64  `json:"processed"`
+	Dropped         uint64  `json:"dropped"`
+	AvgProcessingMs float64 `json:"avg_processing_ms"`
+	MaxProcessingMs float64 `json:"max_processing_ms"`
+}
+
+type routerStats struct {
+	mux       sync.Mutex
+	received  uint64
+	processed uint64
+	dropped   uint64
+	totalTime time.Duration
+	maxTime   time.Duration
+}
+
+// startWorkers starts the worker pool. Messages for the same device always go to the same worker, so they are
+// processed in order, while messages for different devices are processed in parallel.
+func (fc *FromFimpRouter) startWorkers() {
+	workerCount := fc.configs.RouterWorkers
+	if workerCount <= 0 {
+		workerCount = defaultWorkerCount
+	}
+	queueSize := fc.configs.RouterQueueSize
+	if queueSize <= 0 {
+		queueSize = defaultWorkerQueueSize
+	}
+	fc.queueFullPolicy = fc.configs.RouterQueueFullPolicy
+	switch fc.queueFullPolicy {
+	case QueueFullPolicyBlock, QueueFullPolicyDropNewest, QueueFullPolicyDropOldest:
+	default:
+		fc.queueFullPolicy = QueueFullPolicyBlock
+	}
+
+	fc.workers = make([]chan *fimpgo.Message, workerCount)
+	for i := range fc.workers {
+		fc.workers[i] = make(chan *fimpgo.Message, queueSize)
+		go fc.runWorker(fc.workers[i])
+	}
+	log.Infof("<router> Started %d workers, queue size %d, queue full policy %s", workerCount, queueSize, fc.queueFullPolicy)
+}
+
+func (fc *FromFimpRouter) runWorker(ch chan *fimpgo.Message) {
+	for msg := range ch {
+		start := time.Now()
+		fc.routeFimpMessage(msg)
+		fc.stats.observe(time.Since(start))
+	}
+}
+
+// dispatch hands msg over to the worker responsible for its device.
+func (fc *FromFimpRouter) dispatch(msg *fimpgo.Message) {
+	ch := fc.workers[fc.workerIndex(msg)]
+	fc.stats.mux.Lock()
+	fc.stats.received++
+	fc.stats.mux.Unlock()
+
+	switch fc.queueFullPolicy {
+	case QueueFullPolicyDropNewest:
+		select {
+		case ch <- msg:
+		default:
+			fc.drop(msg)
+		}
+	case QueueFullPolicyDropOldest:
+		for {
+			select {
+			case ch <- msg:
+				return
+			default:
+			}
+			select {
+			case oldMsg := <-ch:
+				fc.drop(oldMsg)
+			default:
+			}
+		}
+	default:
+		ch <- msg
+	}
+}
+
+func (fc *FromFimpRouter) drop(msg *fimpgo.Message) {
+	fc.stats.mux.Lock()
+	fc.stats.dropped++
+	fc.stats.mux.Unlock()
+	log.Warnf("<router> Worker queue is full, dropping %s from %s", msg.Payload.Type, msg.Topic)
+}
+
+// workerIndex maps a message to a worker. Messages for a device go to the same worker whichever form of its address
+// they use. Adapter level messages share one worker since they change the adapter state.
+func (fc *FromFimpRouter) workerIndex(msg *fimpgo.Message) int {
+	key := "adapter"
+	if msg.Addr != nil && msg.Addr.ResourceType == fimpgo.ResourceTypeDevice && msg.Addr.ServiceAddress != "" {
+		key = msg.Addr.ServiceAddress
+		if addr, err := model.ParseDeviceAddress(key); err == nil {
+			key = addr.String()
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(fc.workers)))
+}
+
+func (st *routerStats) observe(d time.Duration) {
+	st.mux.Lock()
+	defer st.mux.Unlock()
+	st.processed++
+	st.totalTime += d
+	if d > st.maxTime {
+		st.maxTime = d
+	}
+}
+
+// Metrics returns queue depth and processing time statistics.
+func (fc *FromFimpRouter) Metrics() RouterMetrics {
+	metrics := RouterMetrics{Workers: len(fc.workers), QueueFullPolicy: fc.queueFullPolicy}
+	for _, ch := range fc.workers {
+		metrics.QueueDepths = append(metrics.QueueDepths, len(ch))
+		metrics.QueueDepth += len(ch)
+		metrics.QueueCapacity += cap(ch)
+	}
+	metrics.QueueDepth += len(fc.inboundMsgCh)
+
+	fc.stats.mux.Lock()
+	defer fc.stats.mux.Unlock()
+	metrics.Received = fc.stats.received
+	metrics.Processed = fc.stats.processed
+	metrics.Dropped = fc.stats.dropped
+	if fc.stats.processed > 0 {
+		metrics.AvgProcessingMs = float64(fc.stats.totalTime) / float64(fc.stats.processed) / float64(time.Millisecond)
+	}
+	metrics.MaxProcessingMs = float64(fc.stats.maxTime) / float64(time.Millisecond)
+	return metrics
+}
+
+func (fc *FromFimpRouter) sendMetricsReport(reqMsg *fimpgo.Message) {
+	msg := fimpgo.NewMessage("evt.system.metrics_report", model.ServiceName, fimpgo.VTypeObject, fc.Metrics(), nil, nil, reqMsg.Payload)
+	if err := fc.mqt.RespondToRequest(reqMsg.Payload, msg); err != nil {
+		adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeAdapter, ResourceName: model.ServiceName, ResourceAddress: fc.instanceID}
+		fc.mqt.Publish(adr, msg)
+	}
+}
@@ -39,21 +39,31 @@ func main() {
 		fmt.Print(err)
 		panic("Can't load state file.")
 	}
-	client := mill.Client{}
-	config := mill.Config{}
-
+	queue := model.NewCommandQueue(workDir)
+	err = queue.LoadFromFile()
+	if err != nil {
+		fmt.Print(err)
+		panic("Can't load command queue file.")
+	}
 	utils.SetupLog(configs.LogFile, configs.LogLevel, configs.LogFormat)
+	mill.SetBaseURL(configs.MillBaseURL)
 	log.Info("--------------Starting mill----------------")
 	log.Info("Work directory : ", configs.WorkDir)
 	appLifecycle.PublishEvent(model.EventConfiguring, "main", nil)
 
-	mqtt := fimpgo.NewMqttTransport(configs.MqttServerURI, configs.MqttClientIdPrefix, configs.MqttUsername, configs.MqttPassword, true, 1, 1)
+	instanceAddress := configs.GetInstanceAddress()
+	clientID := configs.MqttClientIdPrefix
+	if instanceAddress != "1" {
+		// Instances sharing a broker need their own client id.
+		clientID = fmt.Sprintf("%s_%s", clientID, instanceAddress)
+	}
+	mqtt := fimpgo.NewMqttTransport(configs.MqttServerURI, clientID, configs.MqttUsername, configs.MqttPassword, true, 1, 1)
 	err = mqtt.Start()
 	responder := discovery.NewServiceDiscoveryResponder(mqtt)
-	responder.RegisterResource(model.GetDiscoveryResource())
+	responder.RegisterResource(model.GetDiscoveryResource(instanceAddress))
 	responder.Start()
 
-	fimpRouter := router.NewFromFimpRouter(mqtt, appLifecycle, configs, states)
+	fimpRouter := router.NewFromFimpRouter(mqtt, appLifecycle, configs, states, queue)
 	fimpRouter.Start()
 
 	appLifecycle.SetConnectionState(model.ConnStateDisconnected)
@@ -86,52 +96,60 @@ func main() {
 	}
 	appLifecycle.SetAppState(model.AppStateRunning, nil)
 	//------------------ Sample code --------------------------------------
-	PollString := configs.PollTimeMin
+	PollString := configs.GetPollTimeMin()
 	PollTime, err := strconv.Atoi(PollString)
 	for {
 		appLifecycle.WaitForState("main", model.AppStateRunning)
 		log.Info("Starting ticker")
 		ticker := time.NewTicker(time.Duration(PollTime) * time.Minute)
-		for ; true; <-ticker.C {
-			if configs.Auth.ExpireTime != 0 {
-				log.Debug("Checking expireTime")
-				millis := time.Now().UnixNano() / 1000000
-				if millis > configs.Auth.ExpireTime && millis < configs.Auth.RefreshExpireTime {
-					log.Debug("Trying to set new tokens")
-					accessToken, refreshToken, expireTime, refreshExpireTime, err := config.RefreshToken(configs.Auth.RefreshToken)
-					log.Debug(err)
-					if err == nil {
-						configs.Auth.AccessToken = accessToken
-						configs.Auth.RefreshToken = refreshToken
-						configs.Auth.ExpireTime = expireTime
-						configs.Auth.RefreshExpireTime = refreshExpireTime
-						appLifecycle.SetConnectionState(model.ConnStateConnected)
-					} else {
-						configs.Auth.ExpireTime = 1
-						appLifecycle.SetConnectionState(model.ConnStateDisconnected)
-					}
-					states.SaveToFile()
-					configs.SaveToFile()
-				} else if millis > configs.Auth.RefreshExpireTime {
-					log.Error("30 day refreshExpireTime has expired. Restard adapter or send cmd.auth.login")
-				} else {
-					log.Debug("expiretime is OK")
-				}
+		// Polling stops when the app leaves RUNNING, e.g. after factory reset, and starts again on next login.
+		for ; appLifecycle.AppState() == model.AppStateRunning; <-ticker.C {
+			fimpRouter.RefreshTokens()
+			if err := fimpRouter.UpdateLists(); err == nil {
+				fimpRouter.PropagateRenames()
 			}
-			states.DeviceCollection, states.RoomCollection, states.HomeCollection, states.IndependentDeviceCollection = nil, nil, nil, nil
-			states.HomeCollection, states.RoomCollection, states.DeviceCollection, states.IndependentDeviceCollection = client.UpdateLists(configs.Auth.AccessToken, states.HomeCollection, states.RoomCollection, states.DeviceCollection, states.IndependentDeviceCollection)
 
-			for i := 0; i < len(states.DeviceCollection); i++ {
-				device := reflect.ValueOf(states.DeviceCollection[i])
-				deviceId := strconv.FormatInt(device.FieldByName("DeviceID").Interface().(int64), 10)
-				currentTemp := device.FieldByName("AmbientTemp").Interface().(float64)
-				tempVal := currentTemp
-				props := fimpgo.Props{}
-				props["unit"] = "C"
+			devices := states.Devices()
+			// Only included devices are reported. Ignored devices and devices not included yet aren't known.
+			known := states.GetKnownDevices()
+			for i := 0; i < len(devices); i++ {
+				device := reflect.ValueOf(devices[i])
+				deviceId := model.DeviceAddressOf(devices[i])
+				if _, ok := known[deviceId]; !ok {
+					continue
+				}
+				product := model.DeviceProduct(devices[i])
+				if product.TempSensor {
+					currentTemp := device.FieldByName("AmbientTemp").Interface().(float64)
+					tempVal := currentTemp
+					props := fimpgo.Props{}
+					props["unit"] = "C"
 
-				adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "sensor_temp", ServiceAddress: deviceId}
-				msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, tempVal, props, nil, nil)
-				mqtt.Publish(adr, msg)
+					adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: instanceAddress, ServiceName: "sensor_temp", ServiceAddress: deviceId}
+					msg := fimpgo.NewMessage("evt.sensor.report", "sensor_temp", fimpgo.VTypeFloat, tempVal, props, nil, nil)
+					mqtt.Publish(adr, msg)
+				}
+
+				if product.HumidSensor {
+					humidVal := float64(device.FieldByName("Humidity").Interface().(int))
+					adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: instanceAddress, ServiceName: "sensor_humid", ServiceAddress: deviceId}
+					msg := fimpgo.NewMessage("evt.sensor.report", "sensor_humid", fimpgo.VTypeFloat, humidVal, fimpgo.Props{"unit": "%"}, nil, nil)
+					mqtt.Publish(adr, msg)
+				}
+
+				if product.Switch {
+					switchVal := device.FieldByName("PowerStatus").Interface().(int) == 1
+					adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: instanceAddress, ServiceName: "out_bin_switch", ServiceAddress: deviceId}
+					msg := fimpgo.NewMessage("evt.binary.report", "out_bin_switch", fimpgo.VTypeBool, switchVal, nil, nil, nil)
+					mqtt.Publish(adr, msg)
+				}
+
+				if product.Meter {
+					meterVal := states.AddMeterReading(deviceId, float64(device.FieldByName("CurrentMonthKwh").Interface().(int)))
+					adr := &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: instanceAddress, ServiceName: "meter_elec", ServiceAddress: deviceId}
+					msg := fimpgo.NewMessage("evt.meter.report", "meter_elec", fimpgo.VTypeFloat, meterVal, fimpgo.Props{"unit": "kWh"}, nil, nil)
+					mqtt.Publish(adr, msg)
+				}
 
 				// setpointTemp := strconv.FormatInt(device.FieldByName("SetpointTemp").Interface().(int64), 10)
 				// setpointVal := map[string]interface{}{
@@ -140,7 +158,7 @@ func main() {
 				// 	"unit": "C",
 				// }
 				// if setpointTemp != "0" {
-				// 	adr = &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: "1", ServiceName: "thermostat", ServiceAddress: deviceId}
+				// 	adr = &fimpgo.Address{MsgType: fimpgo.MsgTypeEvt, ResourceType: fimpgo.ResourceTypeDevice, ResourceName: model.ServiceName, ResourceAddress: instanceAddress, ServiceName: "thermostat", ServiceAddress: deviceId}
 				// 	msg = fimpgo.NewMessage("evt.setpoint.report", "thermostat", fimpgo.VTypeStrMap, setpointVal, nil, nil, nil)
 				// 	mqtt.Publish(adr, msg)
 				// }
@@ -148,9 +166,7 @@ func main() {
 			}
 			states.SaveToFile()
 		}
-		appLifecycle.WaitForState(model.AppStateNotConfigured, "main")
+		ticker.Stop()
+		log.Info("Stopping ticker, app state is ", appLifecycle.AppState())
 	}
-
-	mqtt.Stop()
-	time.Sleep(5 * time.Second)
 }
@@ -5,11 +5,12 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// SetupLog configures level, format and output of the standard logger. Secrets are scrubbed from all entries.
 func SetupLog(logfile string, level string, logFormat string) {
 	if logFormat == "json" {
-		log.SetFormatter(&log.JSONFormatter{TimestampFormat: "2006-01-02 15:04:05.999"})
+		log.SetFormatter(&RedactingFormatter{Formatter: &log.JSONFormatter{TimestampFormat: "2006-01-02 15:04:05.999"}})
 	} else {
-		log.SetFormatter(&log.TextFormatter{FullTimestamp: true, ForceColors: true, TimestampFormat: "2006-01-02T15:04:05.999"})
+		log.SetFormatter(&RedactingFormatter{Formatter: &log.TextFormatter{FullTimestamp: true, ForceColors: true, TimestampFormat: "2006-01-02T15:04:05.999"}})
 	}
 
 	logLevel, err := log.ParseLevel(level)
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+// minSecretLength stops short values, like an empty or one letter password, from redacting unrelated text.
+const minSecretLength = 4
+
+var (
+	bearerPattern = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9\-._~+/]+=*`)
+	jwtPattern    = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	// fieldPattern matches secret fields in json ("password":"x"), query strings (password=x) and printed structs (Password:x).
+	fieldPattern = regexp.MustCompile(`(?i)("?[a-z_]*(?:access_?token|refresh_?token|authorization_?code|auth_?code|hub_?token|secret_?token|access_?key|password)"?\s*[:=]\s*"?)([^"\s,}&]+)`)
+
+	secretsMux sync.RWMutex
+	// secrets are the values to scrub, by secret name.
+	secrets = map[string]string{}
+)
+
+// SetSecret makes the redacting formatter scrub value from all log entries. The value replaces the one set before
+// under the same name, so rotated tokens don't pile up.
+func SetSecret(name string, value string) {
+	secretsMux.Lock()
+	if len(value) < minSecretLength {
+		delete(secrets, name)
+	} else {
+		secrets[name] = value
+	}
+	secretsMux.Unlock()
+}
+
+// RemoveSecrets stops scrubbing the secrets whose name starts with prefix. An empty prefix removes all of them.
+func RemoveSecrets(prefix string) {
+	secretsMux.Lock()
+	for name := range secrets {
+		if strings.HasPrefix(name, prefix) {
+			delete(secrets, name)
+		}
+	}
+	secretsMux.Unlock()
+}
+
+// Redact replaces known secrets, secret fields and bearer-looking tokens in s.
+func Redact(s string) string {
+	secretsMux.RLock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	secretsMux.RUnlock()
+	s = bearerPattern.ReplaceAllString(s, "${1}"+redacted)
+	s = jwtPattern.ReplaceAllString(s, redacted)
+	s = fieldPattern.ReplaceAllStringFunc(s, func(match string) string {
+		parts := fieldPattern.FindStringSubmatch(match)
+		if strings.HasPrefix(parts[2], "[REDACTED") {
+			return match
+		}
+		return parts[1] + redacted
+	})
+	return s
+}
+
+// RedactingFormatter scrubs secrets from the message and fields of every entry before handing it to Formatter.
+type RedactingFormatter struct {
+	Formatter log.Formatter
+}
+
+func (rf *RedactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	clean := *entry
+	clean.Message = Redact(entry.Message)
+	clean.Data = make(log.Fields, len(entry.Data))
+	for key, val := range entry.Data {
+		switch v := val.(type) {
+		case string:
+			clean.Data[key] = Redact(v)
+		case error:
+			clean.Data[key] = Redact(v.Error())
+		case int, int64, float64, bool:
+			clean.Data[key] = v
+		default:
+			str := fmt.Sprintf("%+v", v)
+			if cleanStr := Redact(str); cleanStr != str {
+				clean.Data[key] = cleanStr
+			} else {
+				clean.Data[key] = v
+			}
+		}
+	}
+	return rf.Formatter.Format(&clean)
+}
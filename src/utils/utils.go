@@ -3,7 +3,9 @@ package utils
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 func FileExists(filename string) bool {
@@ -37,4 +39,73 @@ func CopyFile(src, dst string) error {
 	defer destination.Close()
 	_, err = io.Copy(destination, source)
 	return err
-}
\ No newline at end of file
+}
+
+// BackupPath returns the path of the previous generation kept by WriteFileAtomic.
+func BackupPath(filename string) string {
+	return filename + ".bak"
+}
+
+// WriteFileAtomic writes data to a temp file in the same directory, syncs it and renames it over filename,
+// so a reader never sees a partially written file. The previous content is kept as a backup generation.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+
+	if FileExists(filename) {
+		if err = copyFileSync(filename, BackupPath(filename)); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tmpName, filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// copyFileSync copies src to dst through a synced temp file, replacing dst atomically.
+func copyFileSync(src, dst string) error {
+	tmpName := dst + ".tmp"
+	if err := CopyFile(src, tmpName); err != nil {
+		return err
+	}
+	f, err := os.Open(tmpName)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, dst)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}